@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/driver/desktop"
+)
+
+// Agent keeps dlpeagle in the system tray with its window closed, so alerts
+// still arrive and queued tags still reach the server.
+type Agent struct {
+	instance *Instance
+	app      fyne.App
+	inbox    *Inbox
+	jobs     *JobQueue
+	menu     *fyne.Menu
+	// OnShow is called to bring the main window back.
+	OnShow func()
+}
+
+func NewAgent(i *Instance, a fyne.App, inbox *Inbox, jobs *JobQueue) *Agent {
+	return &Agent{instance: i, app: a, inbox: inbox, jobs: jobs}
+}
+
+// SetupTray puts the agent's menu in the system tray. It returns false when
+// the driver has no tray.
+func (g *Agent) SetupTray() bool {
+	desk, ok := g.app.(desktop.App)
+	if !ok {
+		return false
+	}
+	show := fyne.NewMenuItem("Show DLPeagle", func() {
+		if g.OnShow != nil {
+			g.OnShow()
+		}
+	})
+	open := fyne.NewMenuItem("Open inbox", func() {
+		if g.inbox.OnOpen != nil {
+			g.inbox.OnOpen()
+		}
+	})
+	tagClipboard := fyne.NewMenuItem("Tag file from clipboard", g.tagClipboard)
+	var pause, autostart *fyne.MenuItem
+	pause = fyne.NewMenuItem("Pause alerts", func() {
+		g.instance.SetPaused(!g.instance.Paused())
+		pause.Checked = g.instance.Paused()
+		g.menu.Refresh()
+	})
+	autostart = fyne.NewMenuItem("Start at login", func() {
+		if err := SetAutostart(!autostart.Checked); err != nil {
+			g.instance.Logger.Println("Error changing autostart:", err)
+			dialog.ShowError(err, g.instance.Window)
+			return
+		}
+		autostart.Checked = AutostartEnabled()
+		g.menu.Refresh()
+	})
+	autostart.Checked = AutostartEnabled()
+	g.menu = fyne.NewMenu("DLPeagle", show, open, tagClipboard, fyne.NewMenuItemSeparator(), pause, autostart)
+	desk.SetSystemTrayMenu(g.menu)
+
+	prev := g.inbox.OnUnreadChange
+	g.inbox.OnUnreadChange = func(n int) {
+		open.Label = "Open inbox"
+		if n > 0 {
+			open.Label = fmt.Sprintf("Open inbox (%d unread)", n)
+		}
+		g.menu.Refresh()
+		if prev != nil {
+			prev(n)
+		}
+	}
+	return true
+}
+
+// tagClipboard queues the files named on the clipboard, as copied from a
+// file manager or typed as paths.
+func (g *Agent) tagClipboard() {
+	files := clipboardFiles(g.instance.Window.Clipboard().Content())
+	if len(files) == 0 {
+		g.app.SendNotification(fyne.NewNotification("Nothing to tag", "The clipboard doesn't name a file."))
+		return
+	}
+	for _, f := range files {
+		g.jobs.Add(f)
+	}
+	g.app.SendNotification(fyne.NewNotification("Tagging", fmt.Sprintf("%d file(s) from the clipboard queued.", len(files))))
+}
+
+// clipboardFiles returns the regular files named in text, one path or
+// file:// URI per line.
+func clipboardFiles(text string) []string {
+	var files []string
+	for _, line := range strings.Split(text, "\n") {
+		path := strings.TrimSpace(line)
+		if strings.HasPrefix(path, "file://") {
+			u, err := url.Parse(path)
+			if err != nil {
+				continue
+			}
+			path = filepath.FromSlash(u.Path)
+		}
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+	}
+	return files
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HitReport is a beacon hit joined with the tag it belongs to.
+type HitReport struct {
+	Notification
+	Tag       Tag       `json:"tag"`
+	TagKnown  bool      `json:"tag_known"`
+	Opened    time.Time `json:"opened"`
+	Hostnames []string  `json:"hostnames,omitempty"`
+	Internal  bool      `json:"internal"`
+	// FirstExternal is set on the first hit for a tag that came from
+	// outside the corporate networks, the moment a document most likely
+	// left the building.
+	FirstExternal bool `json:"first_external"`
+}
+
+// Document names the file the hit concerns, falling back to the tag ID.
+func (r HitReport) Document() string {
+	if r.Tag.FilePath != "" {
+		return filepath.Base(r.Tag.FilePath)
+	}
+	return r.TagID
+}
+
+// HitAnalyzer correlates raw notifications with registered tags and the
+// network they came from.
+type HitAnalyzer struct {
+	instance  *Instance
+	corporate []*net.IPNet
+	resolve   bool
+}
+
+func NewHitAnalyzer(i *Instance, cfg Config) (*HitAnalyzer, error) {
+	a := &HitAnalyzer{instance: i, resolve: cfg.ResolveHits}
+	for _, c := range cfg.CorporateNetworks {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(c))
+		if err != nil {
+			return nil, fmt.Errorf("corporate network %q: %w", c, err)
+		}
+		a.corporate = append(a.corporate, n)
+	}
+	return a, nil
+}
+
+// Internal reports whether ip falls in one of the corporate networks.
+func (a *HitAnalyzer) Internal(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range a.corporate {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Analyze builds the report for n. It must run before n is added to the
+// history so the first-external check only sees earlier hits.
+func (a *HitAnalyzer) Analyze(ctx context.Context, n Notification) HitReport {
+	r := a.report(n)
+	r.Tag, r.TagKnown = a.tag(ctx, n.TagID)
+	if a.resolve && n.IP != "" {
+		lctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		names, err := net.DefaultResolver.LookupAddr(lctx, n.IP)
+		cancel()
+		if err == nil {
+			for k := range names {
+				names[k] = strings.TrimSuffix(names[k], ".")
+			}
+			r.Hostnames = names
+		}
+	}
+	if !r.Internal && n.TagID != "" {
+		r.FirstExternal = true
+		for _, prev := range a.Timeline(ctx, n.TagID) {
+			if prev.ID != n.ID && !prev.Internal && !prev.Opened.After(r.Opened) {
+				r.FirstExternal = false
+				break
+			}
+		}
+	}
+	return r
+}
+
+// Grade rates a report: leaving the network for the first time is the
+// event worth waking someone up for, as is any outside open of a document
+// inspection found restricted data in.
+func (r HitReport) Grade() Severity {
+	switch {
+	case r.FirstExternal, !r.Internal && r.Tag.Classification == LevelRestricted:
+		return SeverityCritical
+	case !r.Internal:
+		return SeverityHigh
+	case !r.TagKnown:
+		return SeverityMedium
+	default:
+		return SeverityLow
+	}
+}
+
+// Summary is a one line description suitable for an alert.
+func (r HitReport) Summary() string {
+	where := "inside the corporate network"
+	if !r.Internal {
+		where = "outside the corporate network"
+	}
+	from := r.IP
+	if len(r.Hostnames) > 0 {
+		from = fmt.Sprintf("%s (%s)", r.IP, r.Hostnames[0])
+	}
+	doc := r.Document()
+	if r.Tag.Classification != "" && r.Tag.Classification != LevelPublic {
+		doc += " (" + string(r.Tag.Classification) + ")"
+	}
+	s := fmt.Sprintf("%s opened %s from %s", doc, where, from)
+	if r.FirstExternal {
+		s = "First external open: " + s
+	}
+	if r.Tag.Recipient != "" {
+		s += ", copy sent to " + r.Tag.Recipient
+	}
+	if r.Tag.Username != "" {
+		s += ", tagged by " + r.Tag.Username
+	}
+	return s
+}
+
+// Timeline returns every hit for tagID, oldest first, without reverse
+// lookups. The local history is capped, so the server's record of the
+// tag's hits is merged in; when the server can't be reached only the hits
+// still in the history are returned.
+func (a *HitAnalyzer) Timeline(ctx context.Context, tagID string) []HitReport {
+	var out []HitReport
+	seen := make(map[string]bool)
+	for _, n := range a.notifications() {
+		if n.TagID == tagID {
+			out = append(out, a.report(n))
+			seen[n.ID] = true
+		}
+	}
+	hits, err := a.instance.Client.Hits(ctx, tagID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		a.instance.Logger.Println("Error getting hits:", err)
+	}
+	for _, h := range hits {
+		if !seen[h.ID] {
+			out = append(out, a.report(h.Notification()))
+		}
+	}
+	sort.SliceStable(out, func(x, y int) bool { return out[x].Opened.Before(out[y].Opened) })
+	return out
+}
+
+// Timelines groups the hits in the local history by tag. Older hits may
+// have been pruned from it; Timeline has a tag's complete list.
+func (a *HitAnalyzer) Timelines() map[string][]HitReport {
+	out := make(map[string][]HitReport)
+	for _, n := range a.notifications() {
+		if n.TagID != "" {
+			out[n.TagID] = append(out[n.TagID], a.report(n))
+		}
+	}
+	for _, t := range out {
+		sort.SliceStable(t, func(x, y int) bool { return t[x].Opened.Before(t[y].Opened) })
+	}
+	return out
+}
+
+func (a *HitAnalyzer) report(n Notification) HitReport {
+	r := HitReport{Notification: n, Internal: a.Internal(n.IP)}
+	r.Opened, _ = time.Parse(time.RFC3339, n.Time)
+	r.Tag, r.TagKnown = a.instance.LookupTag(n.TagID)
+	return r
+}
+
+func (a *HitAnalyzer) notifications() []Notification {
+	a.instance.Memory.RLock()
+	defer a.instance.Memory.RUnlock()
+	return append([]Notification(nil), a.instance.Notifications...)
+}
+
+// tag finds the registered tag locally or asks the server, caching the
+// answer for the inbox and later hits.
+func (a *HitAnalyzer) tag(ctx context.Context, id string) (Tag, bool) {
+	if id == "" {
+		return Tag{}, false
+	}
+	if t, ok := a.instance.LookupTag(id); ok {
+		return t, true
+	}
+	t, err := a.instance.Client.GetTag(ctx, id)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			a.instance.Logger.Println("Error looking up tag:", err)
+		}
+		return Tag{}, false
+	}
+	a.instance.RememberTag(t)
+	return t, true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// EncodeWAV writes 16-bit mono PCM samples as a RIFF/WAVE file.
+func EncodeWAV(w io.Writer, samples []int16, sampleRate int) error {
+	if sampleRate <= 0 {
+		sampleRate = DefaultSampleRate
+	}
+	const (
+		channels      = 1
+		bitsPerSample = 16
+	)
+	dataSize := uint32(len(samples) * 2)
+	blockAlign := uint16(channels * bitsPerSample / 8)
+	hdr := struct {
+		RIFF          [4]byte
+		Size          uint32
+		WAVE          [4]byte
+		Fmt           [4]byte
+		FmtSize       uint32
+		Format        uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+		Data          [4]byte
+		DataSize      uint32
+	}{
+		RIFF:          [4]byte{'R', 'I', 'F', 'F'},
+		Size:          36 + dataSize,
+		WAVE:          [4]byte{'W', 'A', 'V', 'E'},
+		Fmt:           [4]byte{'f', 'm', 't', ' '},
+		FmtSize:       16,
+		Format:        1, // PCM
+		Channels:      channels,
+		SampleRate:    uint32(sampleRate),
+		ByteRate:      uint32(sampleRate) * uint32(blockAlign),
+		BlockAlign:    blockAlign,
+		BitsPerSample: bitsPerSample,
+		Data:          [4]byte{'d', 'a', 't', 'a'},
+		DataSize:      dataSize,
+	}
+	if err := binary.Write(w, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, samples)
+}
+
+// AudioOutput plays a complete WAV file.
+type AudioOutput interface {
+	Play(wav []byte) error
+}
+
+// CommandOutput hands the WAV to a platform player such as aplay or afplay.
+type CommandOutput struct {
+	Name string
+	Args []string // the WAV file path is appended
+}
+
+func (c *CommandOutput) Play(wav []byte) error {
+	f, err := os.CreateTemp("", "dlpeagle-*.wav")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(wav); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	args := append(append([]string{}, c.Args...), f.Name())
+	if c.Name == "powershell" {
+		// SoundPlayer wants the path inside the script, not as an argument
+		args = []string{"-NoProfile", "-Command",
+			fmt.Sprintf("(New-Object Media.SoundPlayer '%s').PlaySync()", f.Name())}
+	}
+	return exec.Command(c.Name, args...).Run()
+}
+
+// BellOutput is the fallback when no player is installed: one terminal bell.
+type BellOutput struct {
+	W io.Writer
+}
+
+func (b *BellOutput) Play(wav []byte) error {
+	_, err := b.W.Write([]byte{7})
+	return err
+}
+
+// DefaultAudioOutput picks the first player available on this system.
+func DefaultAudioOutput() AudioOutput {
+	var candidates []CommandOutput
+	switch runtime.GOOS {
+	case "darwin":
+		candidates = []CommandOutput{{Name: "afplay"}}
+	case "windows":
+		candidates = []CommandOutput{{Name: "powershell"}}
+	default:
+		candidates = []CommandOutput{
+			{Name: "paplay"},
+			{Name: "pw-play"},
+			{Name: "aplay", Args: []string{"-q"}},
+		}
+	}
+	for _, c := range candidates {
+		if _, err := exec.LookPath(c.Name); err == nil {
+			c := c
+			return &c
+		}
+	}
+	return &BellOutput{W: os.Stdout}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// checkWAV parses a 16-bit mono PCM WAV and returns its samples.
+func checkWAV(t *testing.T, wav []byte, rate int) []int16 {
+	t.Helper()
+	if len(wav) < 44 {
+		t.Fatalf("wav is only %d bytes", len(wav))
+	}
+	le := binary.LittleEndian
+	for off, want := range map[int]string{0: "RIFF", 8: "WAVE", 12: "fmt ", 36: "data"} {
+		if got := string(wav[off : off+4]); got != want {
+			t.Fatalf("chunk id at %d is %q, want %q", off, got, want)
+		}
+	}
+	if got := le.Uint32(wav[4:]); int(got) != len(wav)-8 {
+		t.Errorf("RIFF size %d, want %d", got, len(wav)-8)
+	}
+	if got := le.Uint16(wav[20:]); got != 1 {
+		t.Errorf("format %d, want PCM", got)
+	}
+	if got := le.Uint16(wav[22:]); got != 1 {
+		t.Errorf("%d channels, want 1", got)
+	}
+	if got := le.Uint32(wav[24:]); int(got) != rate {
+		t.Errorf("sample rate %d, want %d", got, rate)
+	}
+	if got := le.Uint32(wav[28:]); int(got) != rate*2 {
+		t.Errorf("byte rate %d, want %d", got, rate*2)
+	}
+	if got := le.Uint16(wav[34:]); got != 16 {
+		t.Errorf("%d bits per sample, want 16", got)
+	}
+	size := le.Uint32(wav[40:])
+	if int(size) != len(wav)-44 || size%2 != 0 {
+		t.Fatalf("data length %d, want %d", size, len(wav)-44)
+	}
+	samples := make([]int16, size/2)
+	if err := binary.Read(bytes.NewReader(wav[44:]), le, samples); err != nil {
+		t.Fatal(err)
+	}
+	return samples
+}
+
+func peak(samples []int16) int {
+	max := 0
+	for _, s := range samples {
+		v := int(s)
+		if v < 0 {
+			v = -v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// tone is one burst of sound in a pattern, as heard.
+type tone struct {
+	Hz float64
+	D  time.Duration
+}
+
+// tones splits samples into the bursts between silences of at least a
+// millisecond and measures each burst's length and, from its zero
+// crossings, its frequency.
+func tones(samples []int16, rate int) []tone {
+	var out []tone
+	start, quiet := -1, 0
+	end := func(k int) {
+		burst := samples[start:k]
+		crossings, sign := 0, 0
+		for _, v := range burst {
+			s := 0
+			if v > 0 {
+				s = 1
+			} else if v < 0 {
+				s = -1
+			}
+			if s != 0 && sign != 0 && s != sign {
+				crossings++
+			}
+			if s != 0 {
+				sign = s
+			}
+		}
+		secs := float64(len(burst)) / float64(rate)
+		out = append(out, tone{float64(crossings) / 2 / secs, time.Duration(secs * float64(time.Second))})
+		start = -1
+	}
+	for k, v := range samples {
+		if v != 0 {
+			if start < 0 {
+				start = k
+			}
+			quiet = 0
+			continue
+		}
+		if quiet++; start >= 0 && quiet >= rate/1000 {
+			end(k - quiet + 1)
+		}
+	}
+	if start >= 0 {
+		end(len(samples) - quiet)
+	}
+	return out
+}
+
+// near reports whether got is within 2% of want.
+func near(got, want float64) bool {
+	return math.Abs(got-want) <= want*0.02
+}
+
+func TestSoundBlockWAV(t *testing.T) {
+	for _, rate := range []int{DefaultSampleRate, 22050} {
+		b := NewSoundBlock(200*time.Millisecond, 100*time.Millisecond, 880, rate)
+		samples := checkWAV(t, b.WAV(), rate)
+		// the tone and the silence after it
+		if want := rate * 3 / 10; len(samples) != want {
+			t.Errorf("%d Hz: %d samples, want %d", rate, len(samples), want)
+		}
+		if p := peak(samples[:rate/5]); p < 10000 {
+			t.Errorf("%d Hz: tone peaks at %d, want an audible level", rate, p)
+		}
+		if p := peak(samples[rate/5:]); p != 0 {
+			t.Errorf("%d Hz: gap after the tone peaks at %d, want silence", rate, p)
+		}
+		if got := tones(samples, rate); len(got) != 1 || !near(got[0].Hz, 880) {
+			t.Errorf("%d Hz: heard %v, want one 880 Hz tone", rate, got)
+		}
+	}
+}
+
+func TestPatternWAV(t *testing.T) {
+	base := *SoundBlockIn880Hz(time.Second)
+	short, long := 150*time.Millisecond, 300*time.Millisecond
+	heard := make(map[string]Severity)
+	for _, tc := range []struct {
+		sev  Severity
+		want []tone
+	}{
+		{SeverityLow, []tone{{880, long}}},
+		{SeverityMedium, []tone{{880, short}, {880, short}}},
+		{SeverityHigh, []tone{{880, short}, {1320, short}, {1760, short}}},
+		{SeverityCritical, []tone{{880, short}, {1320, short}, {880, short}, {1320, short}, {1760, long}}},
+	} {
+		samples := checkWAV(t, PatternWAV(AlertPattern(base, tc.sev)), DefaultSampleRate)
+		got := tones(samples, DefaultSampleRate)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: heard %v, want %v", tc.sev, got, tc.want)
+			continue
+		}
+		for k, w := range tc.want {
+			// the ramps start and end on a zero sample or two
+			if !near(got[k].Hz, w.Hz) || got[k].D < w.D-time.Millisecond || got[k].D > w.D {
+				t.Errorf("%s: tone %d is %v, want %v", tc.sev, k, got[k], w)
+			}
+		}
+		// no two severities may share a pitch and rhythm
+		key := fmt.Sprint(tc.want)
+		if other, ok := heard[key]; ok {
+			t.Errorf("%s sounds like %s", tc.sev, other)
+		}
+		heard[key] = tc.sev
+	}
+}
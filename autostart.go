@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var errNoAutostart = errors.New("starting at login is only supported on XDG desktops")
+
+// AutostartPath is the XDG autostart entry that starts the agent at login.
+func AutostartPath() (string, error) {
+	switch runtime.GOOS {
+	case "windows", "darwin", "android", "ios":
+		return "", errNoAutostart
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "autostart", "dlpeagle.desktop"), nil
+}
+
+func AutostartEnabled() bool {
+	path, err := AutostartPath()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// SetAutostart adds or removes the autostart entry running this executable
+// in agent mode.
+func SetAutostart(on bool) error {
+	path, err := AutostartPath()
+	if err != nil {
+		return err
+	}
+	if !on {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	entry := fmt.Sprintf(`[Desktop Entry]
+Type=Application
+Name=DLPeagle
+Comment=Document leak alerts
+Exec=%s agent
+Terminal=false
+X-GNOME-Autostart-enabled=true
+`, desktopExecArg(exe))
+	return WriteFileAtomic(path, []byte(entry), path)
+}
+
+// desktopExecArg quotes s for the Exec key of a desktop entry.
+func desktopExecArg(s string) string {
+	if !strings.ContainsAny(s, " \t\n\"'\\><~|&;$*?#()`") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\\\`, `"`, `\\"`, "`", "\\\\`", `$`, `\\$`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// Word beacon strategies. The field, header image and template are fetched
+// by Word when the document is opened; the custom XML part and the document
+// property are never fetched but survive most edits, so verification can
+// still tie a copy to its tag.
+const (
+	BeaconField       = "field"        // INCLUDEPICTURE field at the end of the body
+	BeaconHeaderImage = "header-image" // externally linked picture in the header
+	BeaconTemplate    = "template"     // remote attached template in settings.xml
+	BeaconCustomXML   = "customxml"    // customXml data store item
+	BeaconProperty    = "property"     // custom document property
+)
+
+// BeaconStrategies lists every strategy, in the order they are applied.
+var BeaconStrategies = []string{BeaconField, BeaconHeaderImage, BeaconTemplate, BeaconCustomXML, BeaconProperty}
+
+// DefaultWordBeacons is the policy used when config.json doesn't set one.
+var DefaultWordBeacons = []string{BeaconField, BeaconHeaderImage, BeaconProperty}
+
+// ParseBeaconStrategies reads a comma separated list of strategy names.
+func ParseBeaconStrategies(s string) ([]string, error) {
+	var out []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !isBeaconStrategy(name) {
+			return nil, fmt.Errorf("unknown beacon strategy %q (want %s)", name, strings.Join(BeaconStrategies, ", "))
+		}
+		out = append(out, name)
+	}
+	return out, nil
+}
+
+func isBeaconStrategy(name string) bool {
+	for _, s := range BeaconStrategies {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// wordBeacons is the beacon policy for Word documents.
+func (i *Instance) wordBeacons() []string {
+	if len(i.Config.WordBeacons) > 0 {
+		return i.Config.WordBeacons
+	}
+	return DefaultWordBeacons
+}
+
+// beaconWordFile returns the Word document at filePath with beacons for
+// trackerURL placed by each strategy.
+func beaconWordFile(filePath, trackerURL string, strategies []string) ([]byte, error) {
+	use := make(map[string]bool)
+	for _, s := range strategies {
+		if !isBeaconStrategy(s) {
+			return nil, fmt.Errorf("unknown beacon strategy %q", s)
+		}
+		use[s] = true
+	}
+	if len(use) == 0 {
+		return nil, fmt.Errorf("no beacon strategies selected")
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := OpenPackage(data)
+	if err != nil {
+		return nil, err
+	}
+	steps := []struct {
+		name string
+		add  func(*Package, string) error
+	}{
+		{BeaconField, addFieldBeacon},
+		{BeaconHeaderImage, addHeaderImageBeacon},
+		{BeaconTemplate, addTemplateBeacon},
+		{BeaconCustomXML, addCustomXMLBeacon},
+		{BeaconProperty, func(pkg *Package, url string) error {
+			return setCustomProperty(pkg, beaconProperty, url)
+		}},
+	}
+	for _, s := range steps {
+		if !use[s.name] {
+			continue
+		}
+		if err := s.add(pkg, trackerURL); err != nil {
+			return nil, fmt.Errorf("%s beacon: %w", s.name, err)
+		}
+	}
+	return pkg.Bytes()
+}
+
+// addFieldBeacon appends a paragraph holding an INCLUDEPICTURE field that
+// fetches trackerURL to the body. The field has no switches: \d would keep
+// the picture out of the file, which some Word versions refuse for remote
+// pictures, and the header-image strategy already covers a linked picture.
+func addFieldBeacon(pkg *Package, trackerURL string) error {
+	doc, err := pkg.XML(pkg.MainDocument())
+	if err != nil {
+		return err
+	}
+	p := etree.NewElement("w:p")
+	fldChar := func(kind string) {
+		p.CreateElement("w:r").CreateElement("w:fldChar").CreateAttr("w:fldCharType", kind)
+	}
+	fldChar("begin")
+	instr := p.CreateElement("w:r").CreateElement("w:instrText")
+	instr.CreateAttr("xml:space", "preserve")
+	instr.SetText(fmt.Sprintf(`INCLUDEPICTURE "%s"`, trackerURL))
+	fldChar("separate")
+	p.CreateElement("w:r").CreateElement("w:t").SetText(" ")
+	fldChar("end")
+	return appendToBody(doc, p)
+}
+
+const (
+	nsWP          = "http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing"
+	nsA           = "http://schemas.openxmlformats.org/drawingml/2006/main"
+	nsPic         = "http://schemas.openxmlformats.org/drawingml/2006/picture"
+	nsDS          = "http://schemas.openxmlformats.org/officeDocument/2006/customXml"
+	nsBeacon      = "urn:dlpeagle:beacon"
+	relImage      = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/image"
+	relTemplate   = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/attachedTemplate"
+	relSettings   = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/settings"
+	relCustomXML  = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/customXml"
+	relItemProps  = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/customXmlProps"
+	typeSettings  = "application/vnd.openxmlformats-officedocument.wordprocessingml.settings+xml"
+	typeCustomXML = "application/xml"
+	typeItemProps = "application/vnd.openxmlformats-officedocument.customXmlProperties+xml"
+	// custom document property holding the beacon URL
+	beaconProperty = "DlpBeacon"
+)
+
+// addHeaderImageBeacon links a one pixel picture from trackerURL into
+// every header, which Word fetches as it lays out the first page.
+func addHeaderImageBeacon(pkg *Package, trackerURL string) error {
+	return addToWordHeaders(pkg, "header", true, func(name string, root *etree.Element, n int) error {
+		id, err := pkg.AddRelationship(name, relImage, trackerURL, "External")
+		if err != nil {
+			return err
+		}
+		if root.SelectAttr("xmlns:r") == nil {
+			root.CreateAttr("xmlns:r", nsR)
+		}
+		if root.SelectAttr("xmlns:wp") == nil {
+			root.CreateAttr("xmlns:wp", nsWP)
+		}
+		root.AddChild(linkedPictureParagraph(id, 0x7D10+n))
+		return nil
+	})
+}
+
+// linkedPictureParagraph is an inline one pixel picture whose image is
+// fetched from the relationship rid rather than stored in the package.
+func linkedPictureParagraph(rid string, docPrID int) *etree.Element {
+	const px = "9525" // one pixel in EMU
+	p := etree.NewElement("w:p")
+	inline := p.CreateElement("w:r").CreateElement("w:drawing").CreateElement("wp:inline")
+	for _, d := range []string{"distT", "distB", "distL", "distR"} {
+		inline.CreateAttr(d, "0")
+	}
+	extent := inline.CreateElement("wp:extent")
+	extent.CreateAttr("cx", px)
+	extent.CreateAttr("cy", px)
+	docPr := inline.CreateElement("wp:docPr")
+	docPr.CreateAttr("id", strconv.Itoa(docPrID))
+	docPr.CreateAttr("name", "Picture "+strconv.Itoa(docPrID))
+	graphic := inline.CreateElement("a:graphic")
+	graphic.CreateAttr("xmlns:a", nsA)
+	data := graphic.CreateElement("a:graphicData")
+	data.CreateAttr("uri", nsPic)
+	pic := data.CreateElement("pic:pic")
+	pic.CreateAttr("xmlns:pic", nsPic)
+	nv := pic.CreateElement("pic:nvPicPr")
+	cNvPr := nv.CreateElement("pic:cNvPr")
+	cNvPr.CreateAttr("id", "0")
+	cNvPr.CreateAttr("name", "")
+	nv.CreateElement("pic:cNvPicPr")
+	fill := pic.CreateElement("pic:blipFill")
+	fill.CreateElement("a:blip").CreateAttr("r:link", rid)
+	fill.CreateElement("a:stretch").CreateElement("a:fillRect")
+	spPr := pic.CreateElement("pic:spPr")
+	xfrm := spPr.CreateElement("a:xfrm")
+	off := xfrm.CreateElement("a:off")
+	off.CreateAttr("x", "0")
+	off.CreateAttr("y", "0")
+	ext := xfrm.CreateElement("a:ext")
+	ext.CreateAttr("cx", px)
+	ext.CreateAttr("cy", px)
+	geom := spPr.CreateElement("a:prstGeom")
+	geom.CreateAttr("prst", "rect")
+	geom.CreateElement("a:avLst")
+	return p
+}
+
+// settingsBeforeTemplate are the w:settings children the schema puts ahead
+// of w:attachedTemplate.
+var settingsBeforeTemplate = map[string]bool{
+	"writeProtection": true, "view": true, "zoom": true, "removePersonalInformation": true,
+	"removeDateAndTime": true, "doNotDisplayPageBoundaries": true, "displayBackgroundShape": true,
+	"printPostScriptOverText": true, "printFractionalCharacterWidth": true, "printFormsData": true,
+	"embedTrueTypeFonts": true, "embedSystemFonts": true, "saveSubsetFonts": true, "saveFormsData": true,
+	"mirrorMargins": true, "alignBordersAndEdges": true, "bordersDoNotSurroundHeader": true,
+	"bordersDoNotSurroundFooter": true, "gutterAtTop": true, "hideSpellingErrors": true,
+	"hideGrammaticalErrors": true, "activeWritingStyle": true, "proofState": true, "formsDesign": true,
+}
+
+// addTemplateBeacon points the document's attached template at trackerURL;
+// Word requests it on open to refresh styles. An existing template
+// reference is replaced.
+func addTemplateBeacon(pkg *Package, trackerURL string) error {
+	main := pkg.MainDocument()
+	name := pkg.RelatedPart(main, relSettings)
+	var doc *etree.Document
+	var err error
+	if name != "" {
+		doc, err = pkg.XML(name)
+	} else {
+		name = path.Join(path.Dir(main), "settings.xml")
+		root := etree.NewElement("w:settings")
+		root.CreateAttr("xmlns:w", nsW)
+		if doc, err = pkg.CreateXML(name, typeSettings, root); err == nil {
+			_, err = pkg.AddRelationship(main, relSettings, path.Base(name), "")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	root := doc.Root()
+	if root.SelectAttr("xmlns:r") == nil {
+		root.CreateAttr("xmlns:r", nsR)
+	}
+	id, err := pkg.AddRelationship(name, relTemplate, trackerURL, "External")
+	if err != nil {
+		return err
+	}
+	tmpl := root.SelectElement("w:attachedTemplate")
+	if tmpl == nil {
+		at := 0
+		for k, c := range root.ChildElements() {
+			if settingsBeforeTemplate[c.Tag] {
+				at = k + 1
+			}
+		}
+		tmpl = etree.NewElement("w:attachedTemplate")
+		insertChildElementAt(root, at, tmpl)
+	}
+	tmpl.RemoveAttr("r:id")
+	tmpl.CreateAttr("r:id", id)
+	return nil
+}
+
+// insertChildElementAt inserts e before the n-th child element of parent,
+// or last when there are fewer.
+func insertChildElementAt(parent *etree.Element, n int, e *etree.Element) {
+	children := parent.ChildElements()
+	if n >= len(children) {
+		parent.AddChild(e)
+		return
+	}
+	parent.InsertChildAt(children[n].Index(), e)
+}
+
+// addCustomXMLBeacon stores trackerURL in a new customXml data store item.
+func addCustomXMLBeacon(pkg *Package, trackerURL string) error {
+	n := 1
+	for pkg.Has(fmt.Sprintf("customXml/item%d.xml", n)) {
+		n++
+	}
+	item := fmt.Sprintf("customXml/item%d.xml", n)
+	props := fmt.Sprintf("customXml/itemProps%d.xml", n)
+
+	root := etree.NewElement("beacon")
+	root.CreateAttr("xmlns", nsBeacon)
+	root.SetText(trackerURL)
+	if _, err := pkg.CreateXML(item, typeCustomXML, root); err != nil {
+		return err
+	}
+	ds := etree.NewElement("ds:datastoreItem")
+	ds.CreateAttr("ds:itemID", "{"+strings.ToUpper(beaconItemID(trackerURL))+"}")
+	ds.CreateAttr("xmlns:ds", nsDS)
+	ds.CreateElement("ds:schemaRefs").CreateElement("ds:schemaRef").CreateAttr("ds:uri", nsBeacon)
+	if _, err := pkg.CreateXML(props, typeItemProps, ds); err != nil {
+		return err
+	}
+	if _, err := pkg.AddRelationship(item, relItemProps, path.Base(props), ""); err != nil {
+		return err
+	}
+	main := pkg.MainDocument()
+	_, err := pkg.AddRelationship(main, relCustomXML, relativeTarget(main, item), "")
+	return err
+}
+
+// beaconItemID is the data store item GUID, the tag ID in the beacon URL
+// when there is one.
+func beaconItemID(trackerURL string) string {
+	if id := uuidPattern.FindString(trackerURL); id != "" {
+		return id
+	}
+	return "00000000-0000-4000-8000-000000000000"
+}
+
+// beaconLocationStrategy names the strategy that leaves beacons in a part
+// of a Word package.
+func beaconLocationStrategy(part string) string {
+	switch {
+	case part == "word/document.xml":
+		return BeaconField
+	case strings.HasPrefix(part, "word/_rels/header"):
+		return BeaconHeaderImage
+	case part == "word/_rels/settings.xml.rels":
+		return BeaconTemplate
+	case strings.HasPrefix(part, "customXml/"):
+		return BeaconCustomXML
+	case part == "docProps/custom.xml":
+		return BeaconProperty
+	}
+	return ""
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runCLI handles the non-GUI subcommands and returns the process exit code.
+func runCLI(i *Instance, args []string) int {
+	switch args[0] {
+	case "history":
+		return cliHistory(i, args[1:])
+	case "ack":
+		return cliAck(i, args[1:])
+	case "timeline":
+		return cliTimeline(i, args[1:])
+	case "verify":
+		return cliVerify(i, args[1:])
+	case "chain":
+		return cliChain(i, args[1:])
+	case "distribute":
+		return cliDistribute(i, args[1:])
+	case "inspect":
+		return cliInspect(i, args[1:])
+	case "enroll":
+		return cliEnroll(i, args[1:])
+	case "outbox":
+		return cliOutbox(i, args[1:])
+	case "help", "-h", "--help":
+		cliUsage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		cliUsage()
+		return 2
+	}
+}
+
+func cliUsage() {
+	fmt.Fprintln(os.Stderr, `usage: dlpeagle [command]
+
+With no command the GUI is started.
+
+commands:
+  agent                                   run in the system tray with the window hidden
+  history [-page n] [-size n] [-unread]   list received notifications
+  ack <id>...                             mark notifications as seen
+  timeline [tag-id]                       list document opens per tag
+  verify [-json] [-offline] <file>...     report each file's tag, owner and integrity
+  chain <tag-id>                          show the tags a document descends from and its derivatives
+  distribute -to <list> [-out path] [-label name] [-mark] [-watermark] [-beacons list] <file>
+                                          write a separately tagged copy per recipient
+  inspect [-json] <file>...               classify files and list the sensitive data found
+  enroll <invite>                         enroll this client with an invite from the server's admin
+  outbox [-retry]                         list tags not yet registered; -retry queues rejected ones again`)
+}
+
+func openHistoryCLI(i *Instance) bool {
+	path, err := DefaultHistoryPath()
+	if err == nil {
+		err = i.LoadHistory(path)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error opening history:", err)
+		return false
+	}
+	return true
+}
+
+func cliHistory(i *Instance, args []string) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	page := fs.Int("page", 1, "page number, newest first")
+	size := fs.Int("size", 20, "entries per page")
+	unread := fs.Bool("unread", false, "only show notifications not yet acknowledged")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *page < 1 || *size < 1 {
+		fmt.Fprintln(os.Stderr, "page and size must be positive")
+		return 2
+	}
+	if !openHistoryCLI(i) {
+		return 1
+	}
+	entries := i.History.Page((*page-1)**size, *size, *unread)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tTAG\tIP\tSEVERITY\tACKED")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%v\n", e.ID, e.Time, e.TagID, e.IP, e.Severity, e.Acked)
+	}
+	tw.Flush()
+	fmt.Printf("page %d, %d of %d notifications (%d unacknowledged)\n",
+		*page, len(entries), i.History.Len(), i.History.Unacked())
+	return 0
+}
+
+func cliAck(i *Instance, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "ack: need at least one notification id")
+		return 2
+	}
+	if !openHistoryCLI(i) {
+		return 1
+	}
+	for _, id := range args {
+		if err := i.History.Ack(id); err != nil {
+			fmt.Fprintln(os.Stderr, "error acknowledging", id+":", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func cliTimeline(i *Instance, args []string) int {
+	if !openHistoryCLI(i) {
+		return 1
+	}
+	a := i.Analyzer
+	timelines := a.Timelines()
+	if len(args) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		defer cancel()
+		timelines = map[string][]HitReport{args[0]: a.Timeline(ctx, args[0])}
+	}
+	ids := make([]string, 0, len(timelines))
+	for id := range timelines {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, id := range ids {
+		hits := timelines[id]
+		if len(hits) == 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "%s (%s)\n", hits[0].Document(), id)
+		for _, r := range hits {
+			where := "internal"
+			if !r.Internal {
+				where = "external"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", r.Time, r.IP, where, r.UserAgent)
+		}
+	}
+	tw.Flush()
+	return 0
+}
+
+// cliVerify exits 0 only when every file carries an intact, registered tag
+// or, with -offline, a beacon signed with a trusted key.
+func cliVerify(i *Instance, args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print results as JSON")
+	offline := fs.Bool("offline", false, "only check beacon signatures, without the server")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "verify: need at least one file")
+		return 2
+	}
+	code := 0
+	var results []Verification
+	for _, path := range fs.Args() {
+		var v Verification
+		var err error
+		if *offline {
+			v, err = i.VerifyFileOffline(path)
+		} else {
+			v, err = i.VerifyFile(context.Background(), path)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			code = 1
+			continue
+		}
+		if !v.OK() {
+			code = 1
+		}
+		if *asJSON {
+			results = append(results, v)
+		} else {
+			fmt.Println(v)
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+	}
+	return code
+}
+
+func cliChain(i *Instance, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "chain: need exactly one tag id")
+		return 2
+	}
+	chain, err := i.Client.Chain(context.Background(), args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error fetching chain:", err)
+		return 1
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPARENT\tCREATED\tUSER\tTYPE\tSIZE\tFILE")
+	for _, t := range chain {
+		mark := ""
+		if t.ID == args[0] {
+			mark = "*"
+		}
+		fmt.Fprintf(tw, "%s%s\t%s\t%s\t%s\t%s\t%d\t%s\n", mark, t.ID, t.ParentID,
+			time.Unix(int64(t.Created), 0).Format(time.RFC3339), t.Username, t.MIMEType, t.Size, t.FilePath)
+	}
+	tw.Flush()
+	return 0
+}
+
+func cliDistribute(i *Instance, args []string) int {
+	fs := flag.NewFlagSet("distribute", flag.ContinueOnError)
+	to := fs.String("to", "", "recipient list, CSV (name,email,organization) or vCard")
+	out := fs.String("out", "", "output directory, or a .zip file (default <file>_copies next to the file)")
+	fs.StringVar(&i.Label, "label", "", "classification label (default: derived from the content)")
+	fs.BoolVar(&i.Marking, "mark", false, "add the label as a visible header or footer")
+	fs.BoolVar(&i.Watermark, "watermark", false, "add a visible watermark naming the recipient")
+	beacons := fs.String("beacons", strings.Join(i.wordBeacons(), ","), "Word beacon strategies: "+strings.Join(BeaconStrategies, ", "))
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 || *to == "" {
+		fmt.Fprintln(os.Stderr, "distribute: need -to and exactly one file")
+		return 2
+	}
+	strategies, err := ParseBeaconStrategies(*beacons)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "distribute:", err)
+		return 2
+	}
+	i.Config.WordBeacons = strategies
+	source := fs.Arg(0)
+	if *out == "" {
+		*out = strings.TrimSuffix(source, filepath.Ext(source)) + "_copies"
+	}
+	recipients, err := LoadRecipients(*to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading recipients:", err)
+		return 1
+	}
+	copies, err := i.Distribute(source, recipients, *out)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, c := range copies {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Recipient, c.Tag.ID, c.Name)
+	}
+	tw.Flush()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error distributing:", err)
+		return 1
+	}
+	fmt.Printf("%d copies written to %s, manifest in %s\n", len(copies), *out, ManifestPath(*out))
+	return 0
+}
+
+func cliInspect(i *Instance, args []string) int {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print results as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "inspect: need at least one file")
+		return 2
+	}
+	code := 0
+	results := make(map[string]Inspection)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, path := range fs.Args() {
+		in, err := i.Inspector.InspectFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			code = 1
+			continue
+		}
+		results[path] = in
+		if !*asJSON {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", path, in.Level, in.Summary())
+			for _, f := range in.Findings {
+				fmt.Fprintf(tw, "\t  %s\t%s (%s)\n", f.Rule, f.Sample, f.Level)
+			}
+		}
+	}
+	tw.Flush()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+	}
+	return code
+}
+
+// cliEnroll saves the invite the server's admin issued for this client and
+// enrolls with it. If the server can't be reached the invite is kept and
+// used by the next enrollment attempt.
+func cliEnroll(i *Instance, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "enroll: need the invite")
+		return 2
+	}
+	path, err := DefaultInvitePath()
+	if err == nil {
+		err = os.WriteFile(path, []byte(strings.TrimSpace(args[0])+"\n"), 0600)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error saving invite:", err)
+		return 1
+	}
+	if err := i.Enroll(i.TLS); err != nil {
+		fmt.Fprintln(os.Stderr, "error enrolling:", err)
+		return 1
+	}
+	fmt.Println("enrolled")
+	return 0
+}
+
+func cliOutbox(i *Instance, args []string) int {
+	fs := flag.NewFlagSet("outbox", flag.ContinueOnError)
+	retry := fs.Bool("retry", false, "queue the tags the server rejected again")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if i.Outbox == nil {
+		fmt.Fprintln(os.Stderr, "outbox: not available")
+		return 1
+	}
+	if *retry {
+		// main flushes the outbox once the command returns
+		if err := i.Outbox.Retry(); err != nil {
+			fmt.Fprintln(os.Stderr, "error retrying:", err)
+			return 1
+		}
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, e := range i.Outbox.Entries() {
+		state := fmt.Sprintf("retrying at %s", e.NextAttempt.Format("2006-01-02 15:04:05"))
+		if e.Rejected {
+			state = "rejected"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d attempts\t%s\n", e.Tag.ID, e.Tag.FilePath, state, e.Attempts, e.LastError)
+	}
+	tw.Flush()
+	return 0
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds every request to the tracking server.
+const DefaultTimeout = 15 * time.Second
+
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrRejected means the server refused the request itself, e.g. a tag
+	// whose signature doesn't verify; retrying it won't help.
+	ErrRejected = errors.New("rejected")
+)
+
+// APIError is returned for any non-2xx response. It matches ErrNotFound,
+// ErrUnauthorized and ErrRejected with errors.Is.
+type APIError struct {
+	Op         string
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s: %d %s: %s", e.Op, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+	}
+	return fmt.Sprintf("%s: %d %s", e.Op, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrRejected:
+		return e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusConflict ||
+			e.StatusCode == http.StatusUnprocessableEntity
+	}
+	return false
+}
+
+// Client talks to the tracking server's tag API.
+type Client struct {
+	BaseURL  string
+	Username string
+	Password string
+	HTTP     *http.Client
+}
+
+func NewClient(api API, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	return &Client{
+		BaseURL:  strings.TrimRight(api.URL, "/"),
+		Username: api.Username,
+		Password: api.Password,
+		HTTP:     httpClient,
+	}
+}
+
+// Ping checks that the server is reachable and accepts our credentials.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.do(ctx, "ping", http.MethodGet, "/access", nil, nil)
+}
+
+// RegisterTag records a new tag. Registering an ID twice is not an error.
+func (c *Client) RegisterTag(ctx context.Context, t Tag) error {
+	return c.do(ctx, "register tag", http.MethodPost, "/tag", t, nil)
+}
+
+func (c *Client) GetTag(ctx context.Context, id string) (Tag, error) {
+	var t Tag
+	err := c.do(ctx, "get tag", http.MethodGet, "/tag/"+url.PathEscape(id), nil, &t)
+	return t, err
+}
+
+// ListTags returns the tags registered by username, or every tag the
+// credentials can see when username is empty.
+func (c *Client) ListTags(ctx context.Context, username string) ([]Tag, error) {
+	path := "/tag"
+	if username != "" {
+		path += "?" + url.Values{"username": {username}}.Encode()
+	}
+	var tags []Tag
+	err := c.do(ctx, "list tags", http.MethodGet, path, nil, &tags)
+	return tags, err
+}
+
+// Chain returns the provenance chain through id: ancestors oldest first,
+// the tag itself, then the tags derived from it.
+func (c *Client) Chain(ctx context.Context, id string) ([]Tag, error) {
+	var tags []Tag
+	err := c.do(ctx, "tag chain", http.MethodGet, "/tag/"+url.PathEscape(id)+"/chain", nil, &tags)
+	return tags, err
+}
+
+// Hit is one fetch of a tag's beacon as the server recorded it.
+type Hit struct {
+	ID        string    `json:"id"`
+	TagID     string    `json:"tag_id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Time      time.Time `json:"time"`
+}
+
+// Notification is the hit as it would have been pushed to us.
+func (h Hit) Notification() Notification {
+	return Notification{
+		ID:        h.ID,
+		TagID:     h.TagID,
+		IP:        h.IP,
+		UserAgent: h.UserAgent,
+		Time:      h.Time.Format(time.RFC3339),
+	}
+}
+
+// Hits returns every recorded fetch of id's beacon, which the server keeps
+// for as long as the tag.
+func (c *Client) Hits(ctx context.Context, id string) ([]Hit, error) {
+	var hits []Hit
+	err := c.do(ctx, "tag hits", http.MethodGet, "/tag/"+url.PathEscape(id)+"/hits", nil, &hits)
+	return hits, err
+}
+
+// RevokeTag tells the server to stop reporting hits for id. A signed tag
+// can only be revoked with signature, see SignRevocation.
+func (c *Client) RevokeTag(ctx context.Context, id, signature string) error {
+	req, err := c.request(ctx, http.MethodDelete, "/tag/"+url.PathEscape(id), nil)
+	if err != nil {
+		return fmt.Errorf("revoke tag: %w", err)
+	}
+	if signature != "" {
+		req.Header.Set("X-Device-Signature", signature)
+	}
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("revoke tag: %w", err)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	return checkStatus("revoke tag", res)
+}
+
+// Enroll submits a PEM CSR along with the device key tags will be signed
+// with, its signature of the CSR and, on first enrollment, the invite the
+// server issued for this client, and returns the signed PEM certificate.
+func (c *Client) Enroll(ctx context.Context, csrPEM []byte, deviceKey, signature, invite string) ([]byte, error) {
+	req, err := c.request(ctx, http.MethodPost, "/enroll", bytes.NewReader(csrPEM))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-pem-file")
+	req.Header.Set("X-Device-Key", deviceKey)
+	req.Header.Set("X-Device-Signature", signature)
+	if invite != "" {
+		req.Header.Set("X-Enroll-Token", invite)
+	}
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("enroll: %w", err)
+	}
+	defer res.Body.Close()
+	if err := checkStatus("enroll", res); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(res.Body)
+}
+
+// Fetch downloads a file published by the server, e.g. a tagged PDF. Only
+// URLs on the server are fetched, so the credentials go nowhere else.
+func (c *Client) Fetch(ctx context.Context, rawURL string) ([]byte, error) {
+	path, ok := strings.CutPrefix(rawURL, c.BaseURL)
+	if !ok || !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("fetch: %s is not on %s", rawURL, c.BaseURL)
+	}
+	req, err := c.request(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetch: %w", err)
+	}
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch: %w", err)
+	}
+	defer res.Body.Close()
+	if err := checkStatus("fetch", res); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetch: %w", err)
+	}
+	return data, nil
+}
+
+func (c *Client) request(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.Username, c.Password)
+	return req, nil
+}
+
+// do sends in as JSON (when non-nil) and decodes the response into out
+// (when non-nil).
+func (c *Client) do(ctx context.Context, op, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := c.request(ctx, method, path, body)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if out != nil {
+		req.Header.Set("Accept", "application/json")
+	}
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer res.Body.Close()
+	if err := checkStatus(op, res); err != nil {
+		return err
+	}
+	if out == nil {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s: decoding response: %w", op, err)
+	}
+	return nil
+}
+
+func checkStatus(op string, res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	return &APIError{Op: op, StatusCode: res.StatusCode, Message: strings.TrimSpace(string(msg))}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testClient(t *testing.T, h http.HandlerFunc) *Client {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return NewClient(API{URL: srv.URL + "/", Username: "admin", Password: "secret"}, nil)
+}
+
+func TestClientStatus(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		is     []error // sentinels the error must match
+		isNot  []error
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusCreated},
+		{status: http.StatusNoContent},
+		{http.StatusBadRequest, []error{ErrRejected}, []error{ErrUnauthorized, ErrNotFound}},
+		{http.StatusUnauthorized, []error{ErrUnauthorized}, []error{ErrRejected, ErrNotFound}},
+		{http.StatusForbidden, []error{ErrUnauthorized}, []error{ErrRejected, ErrNotFound}},
+		{http.StatusNotFound, []error{ErrNotFound}, []error{ErrRejected, ErrUnauthorized}},
+		{http.StatusConflict, []error{ErrRejected}, []error{ErrUnauthorized, ErrNotFound}},
+		{http.StatusUnprocessableEntity, []error{ErrRejected}, []error{ErrUnauthorized, ErrNotFound}},
+		{http.StatusInternalServerError, nil, []error{ErrRejected, ErrUnauthorized, ErrNotFound}},
+		{http.StatusBadGateway, nil, []error{ErrRejected, ErrUnauthorized, ErrNotFound}},
+	} {
+		t.Run(http.StatusText(tc.status), func(t *testing.T) {
+			c := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if u, p, ok := r.BasicAuth(); !ok || u != "admin" || p != "secret" {
+					t.Errorf("credentials %q/%q not sent", u, p)
+				}
+				if r.Method != http.MethodPost || r.URL.Path != "/tag" {
+					t.Errorf("got %s %s, want POST /tag", r.Method, r.URL.Path)
+				}
+				if tc.status >= 300 {
+					http.Error(w, "nope", tc.status)
+					return
+				}
+				w.WriteHeader(tc.status)
+			})
+			err := c.RegisterTag(context.Background(), Tag{ID: "t1"})
+			if tc.status < 300 {
+				if err != nil {
+					t.Fatalf("got %v, want success", err)
+				}
+				return
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != tc.status || apiErr.Message != "nope" {
+				t.Fatalf("got %#v, want an APIError for %d", err, tc.status)
+			}
+			for _, want := range tc.is {
+				if !errors.Is(err, want) {
+					t.Errorf("%v doesn't match %v", err, want)
+				}
+			}
+			for _, not := range tc.isNot {
+				if errors.Is(err, not) {
+					t.Errorf("%v matches %v", err, not)
+				}
+			}
+		})
+	}
+}
+
+func TestClientDecodes(t *testing.T) {
+	c := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tag/t1" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"t1","username":"alice"}`))
+	})
+	tag, err := c.GetTag(context.Background(), "t1")
+	if err != nil || tag.ID != "t1" || tag.Username != "alice" {
+		t.Fatalf("got %+v, %v", tag, err)
+	}
+	if _, err := c.GetTag(context.Background(), "t2"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	done := make(chan struct{})
+	c := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(done)
+	c.HTTP.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	err := c.Ping(context.Background())
+	if err == nil {
+		t.Fatal("ping of a hung server succeeded")
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		t.Fatalf("got %v, want a transport error", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("ping took %v", d)
+	}
+
+	c.HTTP.Timeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Fetch(ctx, c.BaseURL+"/static/x.pdf"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestClientFetch(t *testing.T) {
+	c := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("%PDF-1.7"))
+	})
+	data, err := c.Fetch(context.Background(), c.BaseURL+"/static/x.pdf")
+	if err != nil || string(data) != "%PDF-1.7" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	if _, err := c.Fetch(context.Background(), "http://elsewhere.example/x.pdf"); err == nil {
+		t.Fatal("fetched a URL that isn't on the server")
+	}
+}
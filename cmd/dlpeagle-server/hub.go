@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rexlx/dlpeagle/internal/frame"
+)
+
+// Hub pushes hit notifications to the client that registered the tag,
+// identified by the client ID its certificate names. Each client has a
+// pending queue, so alerts raised while it was offline are redelivered when
+// it reconnects and dropped once acked; the queue keeps only the newest
+// maxPending.
+type Hub struct {
+	Logger  *log.Logger
+	mu      sync.Mutex
+	live    map[*session]struct{}
+	pending map[string][]Notification // client id -> unacked, oldest first
+}
+
+const (
+	maxPending = 256
+	// sendBuffer is how many notifications wait for a slow client before
+	// new ones are left for redelivery on its next connect.
+	sendBuffer   = 64
+	writeTimeout = 10 * time.Second
+)
+
+type session struct {
+	clientID string
+	stream   quic.Stream
+	fw       *frame.Writer
+	send     chan Notification
+}
+
+// write sends one frame, giving up on a client that stops reading.
+func (s *session) write(t frame.MessageType, v any) error {
+	s.stream.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return s.fw.Write(t, v)
+}
+
+func NewHub(logger *log.Logger) *Hub {
+	return &Hub{
+		Logger:  logger,
+		live:    make(map[*session]struct{}),
+		pending: make(map[string][]Notification),
+	}
+}
+
+// Serve accepts client connections until ctx is cancelled. The listener's
+// TLS config requires a client certificate signed by our CA, so only
+// enrolled clients ever reach handle.
+func (h *Hub) Serve(ctx context.Context, ln *quic.Listener) error {
+	for {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go h.handle(ctx, conn)
+	}
+}
+
+func (h *Hub) handle(ctx context.Context, conn quic.Connection) {
+	defer conn.CloseWithError(0, "bye")
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		h.Logger.Println("accept stream:", err)
+		return
+	}
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	msg, err := frame.ReadMessage(stream)
+	if err != nil || msg.Type != frame.MsgHello {
+		h.Logger.Println("expected hello from", conn.RemoteAddr(), err)
+		return
+	}
+	var hello Notification
+	if err := msg.Decode(&hello); err != nil {
+		h.Logger.Println("bad hello:", err)
+		return
+	}
+	// the certificate, not the hello, says who this is
+	clientID := hello.ID
+	if certs := conn.ConnectionState().TLS.PeerCertificates; len(certs) > 0 {
+		clientID = certs[0].Subject.CommonName
+	}
+	s := &session{
+		clientID: clientID,
+		stream:   stream,
+		fw:       frame.NewWriter(stream),
+		send:     make(chan Notification, sendBuffer),
+	}
+	if err := s.write(frame.MsgAck, frame.Ack{ID: hello.ID}); err != nil {
+		return
+	}
+	backlog := h.join(s)
+	defer h.leave(s)
+	h.Logger.Printf("client %s connected from %v (%d queued)", clientID, conn.RemoteAddr(), len(backlog))
+	for _, n := range backlog {
+		if err := s.write(frame.MsgNotification, n); err != nil {
+			return
+		}
+	}
+	go h.push(conn, s)
+
+	for {
+		// clients ping every 20s; give them some slack
+		stream.SetReadDeadline(time.Now().Add(time.Minute))
+		msg, err := frame.ReadMessage(stream)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				h.Logger.Printf("client %s: %v", clientID, err)
+			}
+			return
+		}
+		switch msg.Type {
+		case frame.MsgPing:
+			if err := s.write(frame.MsgAck, frame.Ack{}); err != nil {
+				return
+			}
+		case frame.MsgAck:
+			var ack frame.Ack
+			if msg.Decode(&ack) == nil && ack.ID != "" {
+				h.ack(clientID, ack.ID)
+			}
+		}
+	}
+}
+
+// push writes the notifications queued for s until its connection closes.
+// A write that times out closes the connection; what wasn't acked stays
+// pending.
+func (h *Hub) push(conn quic.Connection, s *session) {
+	for {
+		select {
+		case <-conn.Context().Done():
+			return
+		case n := <-s.send:
+			if err := s.write(frame.MsgNotification, n); err != nil {
+				h.Logger.Printf("push to %s: %v", s.clientID, err)
+				conn.CloseWithError(0, "write failed")
+				return
+			}
+		}
+	}
+}
+
+func (h *Hub) join(s *session) []Notification {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.live[s] = struct{}{}
+	return append([]Notification(nil), h.pending[s.clientID]...)
+}
+
+func (h *Hub) leave(s *session) {
+	h.mu.Lock()
+	delete(h.live, s)
+	h.mu.Unlock()
+	h.Logger.Printf("client %s disconnected", s.clientID)
+}
+
+func (h *Hub) ack(clientID, id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	q := h.pending[clientID]
+	for k := range q {
+		if q[k].ID == id {
+			h.pending[clientID] = append(q[:k:k], q[k+1:]...)
+			return
+		}
+	}
+}
+
+// Notify queues n for clientID, dropping the oldest pending notification
+// when the queue is full, and hands it to the client's live sessions. It
+// never waits on a client.
+func (h *Hub) Notify(clientID string, n Notification) {
+	h.mu.Lock()
+	q := append(h.pending[clientID], n)
+	if len(q) > maxPending {
+		q = append([]Notification(nil), q[len(q)-maxPending:]...)
+	}
+	h.pending[clientID] = q
+	var live []*session
+	for s := range h.live {
+		if s.clientID == clientID {
+			live = append(live, s)
+		}
+	}
+	h.mu.Unlock()
+	for _, s := range live {
+		select {
+		case s.send <- n:
+		default:
+			h.Logger.Printf("client %s is behind, %s left for redelivery", s.clientID, n.ID)
+		}
+	}
+}
+
+// Connected returns the number of live sessions.
+func (h *Hub) Connected() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.live)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errBadInvite = errors.New("enrollment needs an unexpired invite issued for this client id")
+
+// Invites issues and checks the enrollment tokens that let a client ID be
+// enrolled for the first time. Every client shares the API account, so the
+// account can't tell users apart; an invite handed to one user out of band
+// can. A token is an HMAC of the client ID and its expiry under a key kept
+// in invite.key, so the server and the invite command share no other state.
+type Invites struct {
+	key []byte
+}
+
+func LoadOrCreateInvites(dir string) (*Invites, error) {
+	path := filepath.Join(dir, "invite.key")
+	key, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, key, 0600); err != nil {
+			return nil, err
+		}
+		return &Invites{key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < 32 {
+		return nil, errors.New("invite.key is too short")
+	}
+	return &Invites{key: key}, nil
+}
+
+// Issue returns a token that enrolls clientID until ttl has passed.
+func (iv *Invites) Issue(clientID string, ttl time.Duration) string {
+	payload := clientID + "\n" + strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return b64.EncodeToString([]byte(payload)) + "." + b64.EncodeToString(iv.mac(payload))
+}
+
+// Check reports whether token was issued for clientID and hasn't expired.
+func (iv *Invites) Check(token, clientID string) error {
+	p, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return errBadInvite
+	}
+	raw, err := b64.DecodeString(p)
+	if err != nil {
+		return errBadInvite
+	}
+	mac, err := b64.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, iv.mac(string(raw))) {
+		return errBadInvite
+	}
+	id, exp, ok := strings.Cut(string(raw), "\n")
+	if !ok || id != clientID {
+		return errBadInvite
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return errBadInvite
+	}
+	return nil
+}
+
+func (iv *Invites) mac(payload string) []byte {
+	h := hmac.New(sha256.New, iv.key)
+	h.Write([]byte("dlpeagle invite\n" + payload))
+	return h.Sum(nil)
+}
@@ -0,0 +1,141 @@
+// Command dlpeagle-server is the tracking server the dlpeagle client
+// registers tags with. It serves the beacons embedded in tagged documents and
+// pushes every hit to connected clients over QUIC.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rexlx/dlpeagle/internal/frame"
+)
+
+func main() {
+	addr := flag.String("addr", ":8081", "HTTP listen address")
+	quicAddr := flag.String("quic", ":4242", "QUIC listen address for client notifications")
+	dataDir := flag.String("data", "server-data", "directory for tags, hits and the CA")
+	publicURL := flag.String("public-url", "http://localhost:8081", "externally reachable base URL for beacons")
+	hosts := flag.String("hosts", "localhost,127.0.0.1", "comma separated names for the QUIC server certificate")
+	username := flag.String("user", "admin", "API username")
+	password := flag.String("password", "password", "API password")
+	python := flag.String("python", "python3", "python interpreter for the pdf script")
+	script := flag.String("pdf-script", "scripts/add.py", "script that adds the beacon link to uploaded PDFs")
+	trustProxy := flag.Bool("trust-proxy", false, "use X-Forwarded-For for hit addresses")
+	requireSigned := flag.Bool("require-signed", true, "refuse tags without a valid device signature")
+	inviteTTL := flag.Duration("invite-ttl", 7*24*time.Hour, "how long an invite issued with the invite command is valid")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: dlpeagle-server [flags]\n       dlpeagle-server [flags] invite <client-id>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "server: ", log.LstdFlags)
+	if err := os.MkdirAll(*dataDir, 0700); err != nil {
+		logger.Fatal(err)
+	}
+	invites, err := LoadOrCreateInvites(*dataDir)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if flag.Arg(0) == "invite" {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		// hand this to the user of the client id, who runs dlpeagle enroll
+		fmt.Println(invites.Issue(flag.Arg(1), *inviteTTL))
+		return
+	}
+	store, err := OpenStore(*dataDir)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	ca, err := LoadOrCreateCA(*dataDir)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	staticDir := filepath.Join(*dataDir, "static")
+	if err := os.MkdirAll(staticDir, 0755); err != nil {
+		logger.Fatal(err)
+	}
+	// uploads don't survive a restart, so whatever is left is stale
+	uploadDir := filepath.Join(*dataDir, "uploads")
+	if err := os.RemoveAll(uploadDir); err != nil {
+		logger.Fatal(err)
+	}
+	if err := os.MkdirAll(uploadDir, 0700); err != nil {
+		logger.Fatal(err)
+	}
+	hub := NewHub(logger)
+	srv := &Server{
+		Store:      store,
+		Hub:        hub,
+		CA:         ca,
+		Invites:    invites,
+		Logger:     logger,
+		Username:   *username,
+		Password:   *password,
+		PublicURL:  *publicURL,
+		StaticDir:  staticDir,
+		UploadDir:  uploadDir,
+		Python:     *python,
+		PDFScript:  *script,
+		TrustProxy: *trustProxy,
+
+		RequireSigned: *requireSigned,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cert, err := ca.ServerCert(strings.Split(*hosts, ","))
+	if err != nil {
+		logger.Fatal(err)
+	}
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    ca.Pool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		NextProtos:   []string{frame.ALPN},
+		MinVersion:   tls.VersionTLS13,
+	}
+	ln, err := quic.ListenAddr(*quicAddr, tc, &quic.Config{
+		KeepAlivePeriod: 15 * time.Second,
+		MaxIdleTimeout:  45 * time.Second,
+	})
+	if err != nil {
+		logger.Fatal(err)
+	}
+	go func() {
+		if err := hub.Serve(ctx, ln); err != nil {
+			logger.Println("quic:", err)
+		}
+	}()
+
+	hs := &http.Server{
+		Addr:              *addr,
+		Handler:           srv.Routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hs.Shutdown(shutdown)
+		ln.Close()
+	}()
+	logger.Printf("listening on %s (http) and %s (quic), CA at %s", *addr, *quicAddr, filepath.Join(*dataDir, "ca.pem"))
+	if err := hs.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Fatal(err)
+	}
+}
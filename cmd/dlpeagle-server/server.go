@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// pixel is a transparent 1x1 GIF, the smallest image Word will render.
+var pixel, _ = base64.StdEncoding.DecodeString("R0lGODlhAQABAIAAAAAAAP///yH5BAEAAAAALAAAAAABAAEAAAIBRAA7")
+
+// Server implements the HTTP API the desktop client talks to.
+type Server struct {
+	Store      *Store
+	Hub        *Hub
+	CA         *CA
+	Invites    *Invites
+	Logger     *log.Logger
+	Username   string
+	Password   string
+	PublicURL  string // base of beacon URLs written into PDFs
+	StaticDir  string
+	UploadDir  string // private; uploads and tagged PDFs waiting to be fetched
+	Python     string
+	PDFScript  string
+	TrustProxy bool // take the client IP from X-Forwarded-For
+	// RequireSigned refuses tags without a valid device signature.
+	RequireSigned bool
+
+	mu      sync.Mutex
+	uploads map[string]*upload // tag id -> upload in progress
+	tagged  map[string]*upload // tag id -> tagged PDF waiting to be fetched
+}
+
+// upload is a PDF arriving in chunks, and then its tagged copy.
+type upload struct {
+	user string
+	path string
+	size int64
+	last time.Time // when it was last touched; see expireUploads
+}
+
+// uploadTTL is how long an upload may sit idle, or a tagged copy unfetched,
+// before it's deleted.
+const uploadTTL = 15 * time.Minute
+
+const (
+	maxChunk  = 8 << 20
+	maxUpload = 64 << 20
+)
+
+var errUploadOwner = errors.New("upload was started by another account")
+
+func (s *Server) Routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /access", s.auth(s.handleAccess))
+	mux.HandleFunc("POST /enroll", s.auth(s.handleEnroll))
+	mux.HandleFunc("POST /tag", s.auth(s.handleRegister))
+	mux.HandleFunc("GET /tag", s.auth(s.handleList))
+	mux.HandleFunc("GET /tag/{id}", s.auth(s.handleGet))
+	mux.HandleFunc("DELETE /tag/{id}", s.auth(s.handleRevoke))
+	mux.HandleFunc("GET /tag/{id}/hits", s.auth(s.handleHits))
+	mux.HandleFunc("GET /tag/{id}/chain", s.auth(s.handleChain))
+	mux.HandleFunc("GET /tag/{id}/pdf", s.auth(s.handleTaggedPDF))
+	mux.HandleFunc("POST /upload", s.auth(s.handleUpload))
+	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServer(http.Dir(s.StaticDir))))
+	mux.HandleFunc("GET /{id}", s.handleBeacon)
+	return mux
+}
+
+type userKey struct{}
+
+// auth checks the request's basic auth credentials and passes the username
+// on in the request context, see user.
+func (s *Server) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(u), []byte(s.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(s.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dlpeagle"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	}
+}
+
+// user returns the username auth authenticated the request as.
+func user(r *http.Request) string {
+	u, _ := r.Context().Value(userKey{}).(string)
+	return u
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handleAccess(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "clients": s.Hub.Connected()})
+}
+
+// handleEnroll issues a client certificate for the client ID the CSR names
+// and binds that ID to the enrolling account and to the device key in
+// X-Device-Key. The hub identifies clients by the certificate and tags are
+// only accepted from the bound account, signed with the bound key.
+//
+// The request must be signed with the device key (X-Device-Signature), and
+// the first enrollment of an ID needs an invite issued for it (X-Enroll-
+// Token), since the shared API account doesn't say who is asking. Later
+// enrollments, e.g. after the certificate was lost, only need the bound key.
+func (s *Server) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	csr, err := ParseCSR(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := r.Header.Get("X-Device-Key")
+	if pub, err := b64.DecodeString(key); err != nil || len(pub) != ed25519.PublicKeySize {
+		http.Error(w, "X-Device-Key must be an ed25519 public key", http.StatusBadRequest)
+		return
+	}
+	if !verifyEnrollment(body, r.Header.Get("X-Device-Signature"), key) {
+		http.Error(w, "X-Device-Signature must sign the CSR with the device key", http.StatusBadRequest)
+		return
+	}
+	id := csr.Subject.CommonName
+	if _, enrolled := s.Store.Device(id); !enrolled {
+		if err := s.Invites.Check(r.Header.Get("X-Enroll-Token"), id); err != nil {
+			s.Logger.Printf("refused to enroll %s for %s: %v", id, user(r), err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if err := s.Store.EnrollDevice(id, user(r), key); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errKeyMismatch) {
+			status = http.StatusConflict
+		}
+		s.Logger.Printf("refused to enroll %s for %s: %v", id, user(r), err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	cert, err := s.CA.SignCSR(csr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.Logger.Printf("enrolled %s for %s", id, user(r))
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(cert)
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var t Tag
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := uuid.Parse(t.ID); err != nil {
+		http.Error(w, "tag id must be a uuid", http.StatusBadRequest)
+		return
+	}
+	if err := verifyTag(t); err != nil {
+		if t.Signature != "" || s.RequireSigned {
+			s.Logger.Printf("rejected tag %s from %s: %v", t.ID, t.ClientID, err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if t.Created == 0 {
+		t.Created = int(time.Now().Unix())
+	}
+	t.Owner = user(r)
+	if err := s.Store.PutTag(t); err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errKeyMismatch):
+			status = http.StatusUnprocessableEntity
+		case errors.Is(err, errReplay), errors.Is(err, errImmutable):
+			status = http.StatusConflict
+		case errors.Is(err, errClientMismatch), errors.Is(err, errNotEnrolled):
+			// a client that hasn't enrolled yet retries
+			status = http.StatusForbidden
+		}
+		s.Logger.Printf("rejected tag %s from %s: %v", t.ID, t.ClientID, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	s.Logger.Printf("registered tag %s for %s (%s)", t.ID, t.Username, t.FilePath)
+	writeJSON(w, http.StatusCreated, t)
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Store.ListTags(r.URL.Query().Get("username")))
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.Store.GetTag(r.PathValue("id"))
+	if !ok {
+		http.Error(w, errNoTag.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// handleRevoke stops hits on a tag being reported. Only the account that
+// registered the tag may revoke it and, since clients share accounts, a
+// signed tag also needs its device's signature in X-Device-Signature.
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	t, ok := s.Store.GetTag(id)
+	if !ok {
+		http.Error(w, errNoTag.Error(), http.StatusNotFound)
+		return
+	}
+	if (t.Owner != "" && t.Owner != user(r)) || (t.PublicKey != "" && !verifyRevocation(id, r.Header.Get("X-Device-Signature"), t.PublicKey)) {
+		s.Logger.Printf("refused to revoke %s for %s", id, user(r))
+		http.Error(w, "tag belongs to another client", http.StatusForbidden)
+		return
+	}
+	if err := s.Store.RevokeTag(id); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNoTag) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleHits(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, ok := s.Store.GetTag(id); !ok {
+		http.Error(w, errNoTag.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Store.Hits(id))
+}
+
+func (s *Server) handleChain(w http.ResponseWriter, r *http.Request) {
+	chain, err := s.Store.Chain(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, chain)
+}
+
+// handleUpload receives a PDF in chunks (see HttpStorage.saveFile in the
+// client) into a private temporary file. When the last chunk arrives the
+// link annotation pointing at the tag's beacon is added, along with the
+// label, marking and watermark given in its query string, the upload is
+// deleted and the tagged copy is kept for the uploading account to fetch
+// once from /tag/{id}/pdf. The tag itself is registered afterwards, once
+// the client knows the tagged copy's hash.
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	name := filepath.Base(r.Header.Get("X-filename"))
+	id := r.Header.Get("X-ID")
+	if _, err := uuid.Parse(id); err != nil {
+		http.Error(w, "X-ID must be a tag id", http.StatusBadRequest)
+		return
+	}
+	if !strings.EqualFold(filepath.Ext(name), ".pdf") {
+		http.Error(w, "only pdf uploads are accepted", http.StatusBadRequest)
+		return
+	}
+	up, err := s.startUpload(id, user(r))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUploadOwner) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	f, err := os.OpenFile(up.path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		s.endUpload(id, true)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(f, io.LimitReader(r.Body, maxChunk))
+	f.Close()
+	if err != nil {
+		s.endUpload(id, true)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.mu.Lock()
+	up.size += n
+	size := up.size
+	s.mu.Unlock()
+	if size > maxUpload {
+		s.endUpload(id, true)
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if r.Header.Get("X-Last-Chunk") != "true" {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "partial", "id": id})
+		return
+	}
+	s.endUpload(id, false)
+	if err := s.tagPDF(id, up.path, r.URL.Query()); err != nil {
+		s.Logger.Printf("tagging %s failed: %v", name, err)
+		http.Error(w, "failed to tag pdf", http.StatusInternalServerError)
+		return
+	}
+	s.mu.Lock()
+	s.tagged[id] = &upload{user: up.user, path: filepath.Join(s.UploadDir, id+".pdf"), last: time.Now()}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]string{"status": "complete", "id": id, "url": "/tag/" + id + "/pdf"})
+}
+
+// startUpload returns the upload for tag id, starting it if this is its
+// first chunk.
+func (s *Server) startUpload(id, user string) (*upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireUploads(time.Now())
+	if up, ok := s.uploads[id]; ok {
+		if up.user != user {
+			return nil, errUploadOwner
+		}
+		up.last = time.Now()
+		return up, nil
+	}
+	f, err := os.CreateTemp(s.UploadDir, "upload-*.part")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	if s.uploads == nil {
+		s.uploads = make(map[string]*upload)
+		s.tagged = make(map[string]*upload)
+	}
+	up := &upload{user: user, path: f.Name(), last: time.Now()}
+	s.uploads[id] = up
+	return up, nil
+}
+
+// expireUploads deletes uploads abandoned mid-way and tagged copies nobody
+// fetched, as of now; callers hold s.mu. It runs as uploads start, so what
+// is kept is bounded by recent use.
+func (s *Server) expireUploads(now time.Time) {
+	for _, m := range []map[string]*upload{s.uploads, s.tagged} {
+		for id, up := range m {
+			if now.Sub(up.last) > uploadTTL {
+				os.Remove(up.path)
+				delete(m, id)
+			}
+		}
+	}
+}
+
+// endUpload forgets the upload for id. A failed upload's file is deleted;
+// a complete one is left for tagPDF.
+func (s *Server) endUpload(id string, failed bool) {
+	s.mu.Lock()
+	up, ok := s.uploads[id]
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	if ok && failed {
+		os.Remove(up.path)
+	}
+}
+
+// tagPDF runs the pdf script over the upload at path, leaving the tagged
+// copy as <id>.pdf in UploadDir. The upload itself is always deleted.
+// params carries the beacon's signature as t, the client ID and key it is
+// checked with as c and k, and the label, marking and watermark to add.
+func (s *Server) tagPDF(id, path string, params url.Values) error {
+	defer os.Remove(path)
+	beacon := fmt.Sprintf("%s/%s", strings.TrimRight(s.PublicURL, "/"), id)
+	// the signature, with the client and key that check it offline
+	signed := url.Values{}
+	for _, k := range []string{"c", "k", "t"} {
+		if v := params.Get(k); v != "" {
+			signed.Set(k, v)
+		}
+	}
+	if len(signed) > 0 {
+		beacon += "?" + signed.Encode()
+	}
+	// argparse takes the positionals together, so the url follows the path
+	args := []string{s.PDFScript, path, beacon}
+	for _, opt := range []string{"label", "marking", "watermark"} {
+		if v := params.Get(opt); v != "" {
+			args = append(args, "--"+opt, v)
+		}
+	}
+	out, err := exec.Command(s.Python, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	// the script writes <upload>_new.pdf
+	tagged := strings.TrimSuffix(path, filepath.Ext(path)) + "_new.pdf"
+	return os.Rename(tagged, filepath.Join(s.UploadDir, id+".pdf"))
+}
+
+// handleTaggedPDF hands the tagged copy of an upload to the account that
+// uploaded it, once.
+func (s *Server) handleTaggedPDF(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	s.mu.Lock()
+	up, ok := s.tagged[id]
+	if ok && up.user == user(r) {
+		delete(s.tagged, id)
+	}
+	s.mu.Unlock()
+	if !ok || up.user != user(r) {
+		http.Error(w, "no tagged pdf for this tag", http.StatusNotFound)
+		return
+	}
+	path := up.path
+	defer os.Remove(path)
+	w.Header().Set("Content-Type", "application/pdf")
+	http.ServeFile(w, r, path)
+}
+
+// handleBeacon serves the tracking pixel. Every fetch of a known tag is
+// recorded and pushed to the client that registered it; unknown IDs get the
+// same pixel so the response doesn't reveal which IDs exist. A beacon whose
+// signature doesn't check out against the registered key is still
+// reported, but flagged as forged.
+func (s *Server) handleBeacon(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	defer w.Write(pixel)
+
+	t, ok := s.Store.GetTag(id)
+	if !ok || t.Revoked {
+		return
+	}
+	hit := Hit{
+		ID:        uuid.New().String(),
+		TagID:     id,
+		IP:        s.clientIP(r),
+		UserAgent: r.UserAgent(),
+		Time:      time.Now().UTC(),
+	}
+	if err := s.Store.AddHit(hit); err != nil {
+		s.Logger.Println("recording hit:", err)
+	}
+	s.Logger.Printf("beacon %s fired from %s (%s)", id, hit.IP, hit.UserAgent)
+	info := fmt.Sprintf("%s opened", filepath.Base(t.FilePath))
+	switch token := r.URL.Query().Get("t"); {
+	case token != "" && !verifyBeacon(id, t.ClientID, token, t.PublicKey):
+		info += " (forged signature)"
+	case token == "" && t.Signature != "":
+		info += " (unsigned beacon)"
+	}
+	s.Hub.Notify(t.ClientID, Notification{
+		ID:        hit.ID,
+		Info:      info,
+		Time:      hit.Time.Format(time.RFC3339),
+		TagID:     id,
+		IP:        hit.IP,
+		UserAgent: hit.UserAgent,
+		Severity:  "high",
+	})
+}
+
+func (s *Server) clientIP(r *http.Request) string {
+	if s.TrustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testServer(t *testing.T) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invites, err := LoadOrCreateInvites(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{
+		Store:    store,
+		Hub:      NewHub(log.New(io.Discard, "", 0)),
+		CA:       ca,
+		Invites:  invites,
+		Logger:   log.New(io.Discard, "", 0),
+		Username: "admin",
+		Password: "secret",
+	}
+}
+
+func (s *Server) serve(r *http.Request) *httptest.ResponseRecorder {
+	r.SetBasicAuth(s.Username, s.Password)
+	w := httptest.NewRecorder()
+	s.Routes().ServeHTTP(w, r)
+	return w
+}
+
+func enrollRequest(t *testing.T, clientID string, device ed25519.PrivateKey, invite string) *http.Request {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: clientID},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	r := httptest.NewRequest(http.MethodPost, "/enroll", bytes.NewReader(csr))
+	r.Header.Set("X-Device-Key", b64.EncodeToString(device.Public().(ed25519.PublicKey)))
+	r.Header.Set("X-Device-Signature", b64.EncodeToString(ed25519.Sign(device, append([]byte("dlpeagle enroll "), csr...))))
+	if invite != "" {
+		r.Header.Set("X-Enroll-Token", invite)
+	}
+	return r
+}
+
+func TestEnrollNeedsInvite(t *testing.T) {
+	s := testServer(t)
+	_, alice, _ := ed25519.GenerateKey(rand.Reader)
+	_, mallory, _ := ed25519.GenerateKey(rand.Reader)
+	expired := s.Invites.Issue("alice@desk", -time.Minute)
+	for _, tc := range []struct {
+		name   string
+		device ed25519.PrivateKey
+		invite string
+		status int
+	}{
+		{"no invite", mallory, "", http.StatusForbidden},
+		{"invite for another client", mallory, s.Invites.Issue("mallory@desk", time.Hour), http.StatusForbidden},
+		{"expired invite", mallory, expired, http.StatusForbidden},
+		{"forged invite", mallory, expired[:len(expired)-2] + "AA", http.StatusForbidden},
+		{"invite", alice, s.Invites.Issue("alice@desk", time.Hour), http.StatusOK},
+		{"renewal with the bound key", alice, "", http.StatusOK},
+		{"another key", mallory, s.Invites.Issue("alice@desk", time.Hour), http.StatusConflict},
+	} {
+		w := s.serve(enrollRequest(t, "alice@desk", tc.device, tc.invite))
+		if w.Code != tc.status {
+			t.Errorf("%s: got %d %q, want %d", tc.name, w.Code, w.Body.String(), tc.status)
+		}
+	}
+	if d, _ := s.Store.Device("alice@desk"); d.Key != b64.EncodeToString(alice.Public().(ed25519.PublicKey)) {
+		t.Errorf("alice@desk is bound to %q", d.Key)
+	}
+}
+
+func TestEnrollNeedsDeviceSignature(t *testing.T) {
+	s := testServer(t)
+	_, alice, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	r := enrollRequest(t, "alice@desk", alice, s.Invites.Issue("alice@desk", time.Hour))
+	// the signature must come from the key being bound
+	r.Header.Set("X-Device-Key", b64.EncodeToString(other.Public().(ed25519.PublicKey)))
+	if w := s.serve(r); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRevokeNeedsOwner(t *testing.T) {
+	s := testServer(t)
+	pub, alice, _ := ed25519.GenerateKey(rand.Reader)
+	_, mallory, _ := ed25519.GenerateKey(rand.Reader)
+	key := b64.EncodeToString(pub)
+	if err := s.Store.EnrollDevice("alice@desk", "admin", key); err != nil {
+		t.Fatal(err)
+	}
+	signed := "6a1f4e2c-0000-4000-8000-000000000001"
+	other := "6a1f4e2c-0000-4000-8000-000000000002"
+	for _, tag := range []Tag{
+		{ID: signed, ClientID: "alice@desk", PublicKey: key, Owner: "admin"},
+		{ID: other, ClientID: "bob@desk", Owner: "bob"},
+	} {
+		if err := s.Store.PutTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sign := func(key ed25519.PrivateKey, id string) string {
+		return b64.EncodeToString(ed25519.Sign(key, []byte("dlpeagle revoke "+id)))
+	}
+	for _, tc := range []struct {
+		name, id, sig string
+		status        int
+	}{
+		{"unknown tag", "6a1f4e2c-0000-4000-8000-000000000003", "", http.StatusNotFound},
+		{"another account's tag", other, "", http.StatusForbidden},
+		{"unsigned", signed, "", http.StatusForbidden},
+		{"another device", signed, sign(mallory, signed), http.StatusForbidden},
+		{"signature for another tag", signed, sign(alice, other), http.StatusForbidden},
+		{"owner", signed, sign(alice, signed), http.StatusNoContent},
+	} {
+		r := httptest.NewRequest(http.MethodDelete, "/tag/"+tc.id, nil)
+		if tc.sig != "" {
+			r.Header.Set("X-Device-Signature", tc.sig)
+		}
+		if w := s.serve(r); w.Code != tc.status {
+			t.Errorf("%s: got %d %q, want %d", tc.name, w.Code, w.Body.String(), tc.status)
+		}
+	}
+	if got, _ := s.Store.GetTag(other); got.Revoked {
+		t.Error("another account's tag was revoked")
+	}
+	if got, _ := s.Store.GetTag(signed); !got.Revoked {
+		t.Error("owner's revocation didn't take")
+	}
+}
+
+func TestUploadsExpire(t *testing.T) {
+	s := testServer(t)
+	s.UploadDir = t.TempDir()
+	up, err := s.startUpload("abandoned", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged := filepath.Join(s.UploadDir, "unfetched.pdf")
+	if err := os.WriteFile(tagged, []byte("%PDF"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.tagged["unfetched"] = &upload{user: "admin", path: tagged, last: time.Now()}
+	s.expireUploads(time.Now().Add(uploadTTL / 2))
+	if len(s.uploads) != 1 || len(s.tagged) != 1 {
+		t.Fatal("fresh uploads expired")
+	}
+	s.expireUploads(time.Now().Add(2 * uploadTTL))
+	if len(s.uploads) != 0 || len(s.tagged) != 0 {
+		t.Errorf("%d uploads and %d tagged copies left", len(s.uploads), len(s.tagged))
+	}
+	for _, path := range []string{up.path, tagged} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s not deleted", path)
+		}
+	}
+}
+
+// minimalPDF is a one page PDF with a correct xref table.
+func minimalPDF() []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	var offsets []int
+	for _, obj := range []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] >>",
+	} {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", len(offsets), obj)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return b.Bytes()
+}
+
+func TestTagPDFRunsScript(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 not installed")
+	}
+	if err := exec.Command(python, "-c", "import pikepdf").Run(); err != nil {
+		t.Skip("pikepdf not installed")
+	}
+	s := testServer(t)
+	s.UploadDir = t.TempDir()
+	s.Python = python
+	s.PDFScript = filepath.Join("..", "..", "scripts", "add.py")
+	s.PublicURL = "http://tracker.example/"
+	path := filepath.Join(s.UploadDir, "upload.pdf")
+	if err := os.WriteFile(path, minimalPDF(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	id := "6a1f4e2c-0000-4000-8000-000000000001"
+	params := url.Values{
+		"c":         {"alice@desk"},
+		"k":         {"key"},
+		"t":         {"sig"},
+		"label":     {"Internal"},
+		"marking":   {"INTERNAL"},
+		"watermark": {"alice@desk"},
+	}
+	if err := s.tagPDF(id, path, params); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(s.UploadDir, id+".pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("http://tracker.example/"+id+"?c=alice%40desk&k=key&t=sig")) {
+		t.Error("tagged copy doesn't link to the beacon")
+	}
+}
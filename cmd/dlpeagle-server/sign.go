@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// tagClaims mirrors the client's TagClaims, the payload a device signs.
+type tagClaims struct {
+	ID         string `json:"id"`
+	Username   string `json:"u"`
+	ClientID   string `json:"c"`
+	Created    int    `json:"t"`
+	Hash       string `json:"h,omitempty"` // original file hash
+	TaggedHash string `json:"th,omitempty"`
+	FilePath   string `json:"f,omitempty"`
+	Label      string `json:"l,omitempty"`
+	ParentID   string `json:"p,omitempty"`
+	Recipient  string `json:"r,omitempty"`
+	Key        string `json:"k"`
+}
+
+var (
+	errBadSignature   = errors.New("tag signature does not verify")
+	errUnsigned       = errors.New("tag is not signed")
+	errKeyMismatch    = errors.New("tag is signed with a key not enrolled for this client")
+	errNotEnrolled    = errors.New("client has not enrolled a device key")
+	errClientMismatch = errors.New("client is enrolled under another account")
+	errReplay         = errors.New("tag id is already registered by another client or key")
+	errImmutable      = errors.New("tag is already registered with another tagged hash, path or label")
+)
+
+var b64 = base64.RawURLEncoding
+
+// verifyToken checks a compact "claims.sig" token against the key it names.
+func verifyToken(token string) (tagClaims, error) {
+	var c tagClaims
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return c, errBadSignature
+	}
+	raw, err := b64.DecodeString(payload)
+	if err != nil || json.Unmarshal(raw, &c) != nil {
+		return c, errBadSignature
+	}
+	pub, err := b64.DecodeString(c.Key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return c, errBadSignature
+	}
+	s, err := b64.DecodeString(sig)
+	if err != nil || !ed25519.Verify(pub, []byte(payload), s) {
+		return c, errBadSignature
+	}
+	return c, nil
+}
+
+// verifyBeacon checks the signature a beacon carries for tag id, issued by
+// clientID, against a tag's public key, see the client's SignBeacon.
+func verifyBeacon(id, clientID, sig, key string) bool {
+	pub, err := b64.DecodeString(key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	s, err := b64.DecodeString(sig)
+	return err == nil && ed25519.Verify(pub, []byte("dlpeagle beacon "+id+" "+clientID), s)
+}
+
+// verifyEnrollment checks that an enrollment request, the PEM CSR, was
+// signed with the device key it binds, see the client's SignEnrollment.
+func verifyEnrollment(csr []byte, sig, key string) bool {
+	pub, err := b64.DecodeString(key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	s, err := b64.DecodeString(sig)
+	return err == nil && ed25519.Verify(pub, append([]byte("dlpeagle enroll "), csr...), s)
+}
+
+// verifyRevocation checks the device signature on a request to revoke tag
+// id, see the client's SignRevocation.
+func verifyRevocation(id, sig, key string) bool {
+	pub, err := b64.DecodeString(key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	s, err := b64.DecodeString(sig)
+	return err == nil && ed25519.Verify(pub, []byte("dlpeagle revoke "+id), s)
+}
+
+// verifyTag checks t's signature, that it covers t's own fields and that
+// t's beacon signature was made with the same key.
+func verifyTag(t Tag) error {
+	if t.Signature == "" {
+		return errUnsigned
+	}
+	c, err := verifyToken(t.Signature)
+	if err != nil {
+		return err
+	}
+	if c.Key != t.PublicKey || c.ID != t.ID || c.Username != t.Username ||
+		c.ClientID != t.ClientID || c.Created != t.Created || c.Hash != t.OriginalHash ||
+		c.TaggedHash != t.TaggedHash || c.FilePath != t.FilePath || c.Label != t.Label ||
+		c.ParentID != t.ParentID || c.Recipient != t.Recipient {
+		return errBadSignature
+	}
+	if !verifyBeacon(t.ID, t.ClientID, t.BeaconSignature, t.PublicKey) {
+		return errBadSignature
+	}
+	return nil
+}
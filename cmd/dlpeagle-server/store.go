@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tag mirrors the client's Tag; unknown fields are kept in Extra so newer
+// clients can register richer tags without a server upgrade.
+type Tag struct {
+	Username string `json:"username"`
+	FilePath string `json:"file_path"`
+	ID       string `json:"id"`
+	ClientID string `json:"client_id"`
+	URL      string `json:"url"`
+	Created  int    `json:"created"`
+	Revoked  bool   `json:"revoked,omitempty"`
+
+	OriginalHash string `json:"original_hash"`
+	TaggedHash   string `json:"tagged_hash"`
+	Size         int64  `json:"size"`
+	MIMEType     string `json:"mime_type"`
+	ParentID     string `json:"parent_id,omitempty"`
+	Recipient    string `json:"recipient,omitempty"`
+	Label        string `json:"label,omitempty"`
+	Marking      string `json:"marking,omitempty"`
+	Watermark    string `json:"watermark,omitempty"`
+
+	PublicKey       string `json:"public_key,omitempty"`
+	Signature       string `json:"signature,omitempty"`
+	BeaconSignature string `json:"beacon_signature,omitempty"`
+
+	// Owner is the account that registered the tag, which must be the one
+	// its client enrolled under. Set by the server, never taken from the
+	// request.
+	Owner string `json:"owner,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (t *Tag) UnmarshalJSON(b []byte) error {
+	type plain Tag
+	if err := json.Unmarshal(b, (*plain)(t)); err != nil {
+		return err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return err
+	}
+	// tags registered before original_hash existed carry the original
+	// file's hash as "hash"
+	if h, ok := all["hash"]; ok && t.OriginalHash == "" {
+		json.Unmarshal(h, &t.OriginalHash)
+	}
+	for _, k := range []string{"username", "file_path", "id", "client_id", "hash", "url", "created", "revoked",
+		"original_hash", "tagged_hash", "size", "mime_type", "parent_id", "recipient", "label", "marking", "watermark", "public_key", "signature", "beacon_signature", "owner"} {
+		delete(all, k)
+	}
+	t.Extra = nil
+	if len(all) > 0 {
+		t.Extra = all
+	}
+	return nil
+}
+
+func (t Tag) MarshalJSON() ([]byte, error) {
+	type plain Tag
+	known, err := json.Marshal(plain(t))
+	if err != nil || len(t.Extra) == 0 {
+		return known, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(known, &all); err != nil {
+		return nil, err
+	}
+	for k, v := range t.Extra {
+		if _, ok := all[k]; !ok {
+			all[k] = v
+		}
+	}
+	return json.Marshal(all)
+}
+
+// Hit is one fetch of a tag's beacon.
+type Hit struct {
+	ID        string    `json:"id"`
+	TagID     string    `json:"tag_id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Time      time.Time `json:"time"`
+}
+
+// Notification is what connected clients receive for each hit.
+type Notification struct {
+	ID        string `json:"id"`
+	Info      string `json:"info"`
+	Time      string `json:"time"`
+	TagID     string `json:"tag_id"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Severity  string `json:"severity"`
+}
+
+var errNoTag = errors.New("no such tag")
+
+// Device is an enrolled client: the account that enrolled it and the key
+// it signs tags with.
+type Device struct {
+	Account string `json:"account"`
+	Key     string `json:"key"`
+}
+
+// Store keeps tags in tags.json, enrolled clients in devices.json and
+// appends hits to hits.jsonl under Dir.
+type Store struct {
+	Dir     string
+	mu      sync.RWMutex
+	tags    map[string]Tag
+	devices map[string]Device // client id -> device
+	hits    map[string][]Hit
+}
+
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		Dir:     dir,
+		tags:    make(map[string]Tag),
+		devices: make(map[string]Device),
+		hits:    make(map[string][]Hit),
+	}
+	for name, v := range map[string]any{"tags.json": &s.tags, "devices.json": &s.devices} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			if err := json.Unmarshal(data, v); err != nil {
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	f, err := os.Open(filepath.Join(dir, "hits.jsonl"))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var h Hit
+		if json.Unmarshal(sc.Bytes(), &h) == nil {
+			s.hits[h.TagID] = append(s.hits[h.TagID], h)
+		}
+	}
+	return s, sc.Err()
+}
+
+// EnrollDevice binds client id to the account enrolling it and to the key
+// it signs tags with. A client id is bound once; enrolling it again, e.g.
+// after its certificate was lost, must come from the same account with the
+// same key.
+func (s *Store) EnrollDevice(id, account, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := Device{Account: account, Key: key}
+	if old, ok := s.devices[id]; ok {
+		if old != d {
+			return errKeyMismatch
+		}
+		return nil
+	}
+	s.devices[id] = d
+	return s.save("devices.json", s.devices)
+}
+
+func (s *Store) Device(id string) (Device, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.devices[id]
+	return d, ok
+}
+
+// PutTag registers t. A tag from an enrolled client must come from the
+// account that enrolled it and, if signed, be signed with its device key; a
+// signed tag from a client that never enrolled is refused.
+//
+// Re-registering an existing ID overwrites it, which is what the client's
+// outbox relies on when it retries, but only from the same client with the
+// same key, and without changing the tagged copy's hash, path or label.
+func (s *Store) PutTag(t Tag) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, enrolled := s.devices[t.ClientID]
+	switch {
+	case enrolled && d.Account != t.Owner:
+		return errClientMismatch
+	case t.PublicKey != "" && !enrolled:
+		return errNotEnrolled
+	case t.PublicKey != "" && d.Key != t.PublicKey:
+		return errKeyMismatch
+	}
+	if old, ok := s.tags[t.ID]; ok {
+		if old.ClientID != t.ClientID || old.PublicKey != t.PublicKey {
+			return errReplay
+		}
+		if old.TaggedHash != t.TaggedHash || old.FilePath != t.FilePath || old.Label != t.Label {
+			return errImmutable
+		}
+		t.Revoked = old.Revoked
+	}
+	s.tags[t.ID] = t
+	return s.saveTags()
+}
+
+func (s *Store) GetTag(id string) (Tag, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tags[id]
+	return t, ok
+}
+
+// ListTags returns tags for username (all when empty), newest first.
+func (s *Store) ListTags(username string) []Tag {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]Tag, 0, len(s.tags))
+	for _, t := range s.tags {
+		if username == "" || t.Username == username {
+			out = append(out, t)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Created > out[b].Created })
+	return out
+}
+
+// Chain returns the provenance chain through id: its ancestors oldest
+// first, the tag itself, then every tag derived from it, breadth first.
+func (s *Store) Chain(id string) ([]Tag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tags[id]
+	if !ok {
+		return nil, errNoTag
+	}
+	chain := []Tag{t}
+	seen := map[string]bool{id: true}
+	for p := t.ParentID; p != "" && !seen[p]; {
+		parent, ok := s.tags[p]
+		if !ok {
+			break
+		}
+		seen[p] = true
+		chain = append([]Tag{parent}, chain...)
+		p = parent.ParentID
+	}
+	queue := []string{id}
+	for len(queue) > 0 {
+		var next []string
+		for _, c := range s.children(queue) {
+			if !seen[c.ID] {
+				seen[c.ID] = true
+				chain = append(chain, c)
+				next = append(next, c.ID)
+			}
+		}
+		queue = next
+	}
+	return chain, nil
+}
+
+// children returns the tags whose parent is one of ids, oldest first.
+func (s *Store) children(ids []string) []Tag {
+	parents := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		parents[id] = true
+	}
+	var out []Tag
+	for _, t := range s.tags {
+		if parents[t.ParentID] {
+			out = append(out, t)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Created < out[b].Created })
+	return out
+}
+
+func (s *Store) RevokeTag(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tags[id]
+	if !ok {
+		return errNoTag
+	}
+	t.Revoked = true
+	s.tags[id] = t
+	return s.saveTags()
+}
+
+func (s *Store) AddHit(h Hit) error {
+	out, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(s.Dir, "hits.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(out, '\n')); err != nil {
+		return err
+	}
+	s.hits[h.TagID] = append(s.hits[h.TagID], h)
+	return nil
+}
+
+func (s *Store) Hits(tagID string) []Hit {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Hit(nil), s.hits[tagID]...)
+}
+
+func (s *Store) saveTags() error {
+	return s.save("tags.json", s.tags)
+}
+
+// save rewrites name atomically; callers hold s.mu.
+func (s *Store) save(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.Dir, name)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Config holds the user-editable settings kept in config.json in ConfigDir.
+type Config struct {
+	// CorporateNetworks lists the CIDRs considered inside the company.
+	// Beacon hits from anywhere else are treated as potential leaks. The
+	// default, the private and loopback ranges, only fits a server on the
+	// internal network. A server on the internet sees the company's public
+	// egress addresses instead, which must be listed here, or every open
+	// from the office is reported as external.
+	CorporateNetworks []string `json:"corporate_networks"`
+	// ResolveHits turns on reverse DNS lookups of hit addresses.
+	ResolveHits bool `json:"resolve_hits"`
+	// Inspection adds to or trims the sensitive data rules run on each
+	// document before it is tagged.
+	Inspection InspectionConfig `json:"inspection"`
+	// Classification is the label scheme offered when tagging.
+	Classification ClassificationConfig `json:"classification"`
+	// Watermark is the visible watermark added when it's switched on.
+	Watermark WatermarkConfig `json:"watermark"`
+	// WordBeacons picks the beacon strategies used for Word documents,
+	// see BeaconStrategies.
+	WordBeacons []string `json:"word_beacons"`
+	// Output decides where tagged copies are written.
+	Output OutputConfig `json:"output"`
+	// Watch lists the folders whose documents are tagged automatically.
+	Watch WatchConfig `json:"watch"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		CorporateNetworks: []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "::1/128", "fc00::/7"},
+		ResolveHits:       true,
+		Classification:    DefaultClassification(),
+		Watermark:         DefaultWatermark(),
+		WordBeacons:       DefaultWordBeacons,
+		Output:            DefaultOutput(),
+		Watch:             DefaultWatch(),
+	}
+}
+
+func DefaultConfigPath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+// LoadConfig reads path over the defaults. A missing file is not an error;
+// with any other error the defaults are returned untouched.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return DefaultConfig(), err
+	}
+	return cfg, nil
+}
+
+// SaveConfig writes cfg to path, e.g. after folders are added to the watch
+// list from the GUI.
+func SaveConfig(path string, cfg Config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, append(data, '\n'), path)
+}
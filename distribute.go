@@ -0,0 +1,377 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Recipient is someone a distributed copy is sent to.
+type Recipient struct {
+	Name         string `json:"name"`
+	Email        string `json:"email"`
+	Organization string `json:"organization,omitempty"`
+}
+
+// String is the form recorded on a Tag, e.g. "Ann Lee <ann@example.com>".
+func (r Recipient) String() string {
+	switch {
+	case r.Name != "" && r.Email != "":
+		return fmt.Sprintf("%s <%s>", r.Name, r.Email)
+	case r.Name != "":
+		return r.Name
+	default:
+		return r.Email
+	}
+}
+
+// slug is a file name friendly version of the recipient.
+func (r Recipient) slug() string {
+	s := r.Name
+	if s == "" {
+		s, _, _ = strings.Cut(r.Email, "@")
+	}
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(s) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			b.WriteRune(c)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// LoadRecipients reads a recipient list from a CSV file or a vCard file
+// (.vcf or .vcard).
+func LoadRecipients(path string) ([]Recipient, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rs []Recipient
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".vcf", ".vcard":
+		rs, err = parseVCards(f)
+	default:
+		rs, err = parseRecipientsCSV(f)
+	}
+	if err == nil && len(rs) == 0 {
+		err = fmt.Errorf("no recipients in %s", path)
+	}
+	return rs, err
+}
+
+// parseRecipientsCSV takes name, email and organization columns. A header
+// row naming the columns is optional; without one they're taken in that
+// order.
+func parseRecipientsCSV(r io.Reader) ([]Recipient, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	col := map[string]int{"name": 0, "email": 1, "organization": 2}
+	if len(rows) > 0 {
+		header := make(map[string]int)
+		for k, h := range rows[0] {
+			switch strings.ToLower(strings.TrimSpace(h)) {
+			case "name", "full name", "fn":
+				header["name"] = k
+			case "email", "e-mail", "mail", "email address":
+				header["email"] = k
+			case "organization", "organisation", "org", "company":
+				header["organization"] = k
+			}
+		}
+		if len(header) > 0 {
+			col = map[string]int{"name": -1, "email": -1, "organization": -1}
+			for k, v := range header {
+				col[k] = v
+			}
+			rows = rows[1:]
+		}
+	}
+	field := func(row []string, name string) string {
+		k := col[name]
+		if k < 0 || k >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[k])
+	}
+	var rs []Recipient
+	for _, row := range rows {
+		rec := Recipient{Name: field(row, "name"), Email: field(row, "email"), Organization: field(row, "organization")}
+		if rec.Name != "" || rec.Email != "" {
+			rs = append(rs, rec)
+		}
+	}
+	return rs, nil
+}
+
+// parseVCards reads the FN, EMAIL and ORG properties of each card.
+func parseVCards(r io.Reader) ([]Recipient, error) {
+	var lines []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			// folded continuation of the previous line
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	unescape := strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\N`, " ", `\\`, `\`)
+	var rs []Recipient
+	var cur *Recipient
+	for _, line := range lines {
+		prop, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name, _, _ := strings.Cut(prop, ";")
+		// grouped properties look like item1.EMAIL
+		if k := strings.LastIndex(name, "."); k >= 0 {
+			name = name[k+1:]
+		}
+		switch strings.ToUpper(name) {
+		case "BEGIN":
+			cur = &Recipient{}
+		case "END":
+			if cur != nil && (cur.Name != "" || cur.Email != "") {
+				rs = append(rs, *cur)
+			}
+			cur = nil
+		case "FN":
+			if cur != nil {
+				cur.Name = unescape.Replace(value)
+			}
+		case "EMAIL":
+			if cur != nil && cur.Email == "" {
+				cur.Email = value
+			}
+		case "ORG":
+			if cur != nil {
+				org, _, _ := strings.Cut(value, ";")
+				cur.Organization = unescape.Replace(org)
+			}
+		}
+	}
+	return rs, nil
+}
+
+// showDistribute asks for a recipient list and where the copies go, a
+// folder or a zip file, then writes a tagged copy of source per recipient,
+// reporting progress in status.
+func (i *Instance) showDistribute(source string, status *widget.Label) {
+	dialog.ShowFileOpen(func(list fyne.URIReadCloser, err error) {
+		if err != nil || list == nil {
+			return
+		}
+		list.Close()
+		recipients, err := LoadRecipients(list.URI().Path())
+		if err != nil {
+			dialog.ShowError(err, i.Window)
+			return
+		}
+		run := func(out string) {
+			status.SetText(fmt.Sprintf("Tagging %d copies of %s...", len(recipients), filepath.Base(source)))
+			go func() {
+				copies, err := i.Distribute(source, recipients, out)
+				if err != nil {
+					dialog.ShowError(err, i.Window)
+					status.SetText(fmt.Sprintf("%d of %d tagged copies written to %s", len(copies), len(recipients), out))
+					return
+				}
+				status.SetText(fmt.Sprintf("%d tagged copies written to %s, manifest in %s", len(copies), out, ManifestPath(out)))
+			}()
+		}
+		question := widget.NewLabel(fmt.Sprintf("Save the %d tagged copies in a folder or in a zip file?", len(recipients)))
+		dialog.ShowCustomConfirm("Distribute", "Zip file", "Folder", question, func(zipped bool) {
+			if zipped {
+				i.chooseZip(source, run)
+				return
+			}
+			dialog.ShowFolderOpen(func(dir fyne.ListableURI, err error) {
+				if err != nil || dir == nil {
+					return
+				}
+				run(dir.Path())
+			}, i.Window)
+		}, i.Window)
+	}, i.Window)
+}
+
+// chooseZip asks for the zip file the copies of source go in and passes its
+// path to run.
+func (i *Instance) chooseZip(source string, run func(string)) {
+	d := dialog.NewFileSave(func(w fyne.URIWriteCloser, err error) {
+		if err != nil || w == nil {
+			return
+		}
+		// the dialog creates the file; Distribute rewrites it
+		w.Close()
+		out := w.URI().Path()
+		if !strings.EqualFold(filepath.Ext(out), ".zip") {
+			os.Remove(out)
+			out += ".zip"
+		}
+		run(out)
+	}, i.Window)
+	d.SetFileName(strings.TrimSuffix(filepath.Base(source), filepath.Ext(source)) + "_copies.zip")
+	d.Show()
+}
+
+// DistributedCopy is one recipient's tagged copy.
+type DistributedCopy struct {
+	Recipient Recipient `json:"recipient"`
+	Tag       Tag       `json:"tag"`
+	Name      string    `json:"name"` // file name inside the output
+}
+
+// Distribute writes a separately tagged copy of source for every recipient,
+// so a leak can be traced to the copy it came from. out is a directory, or
+// a zip file when it ends in .zip. A manifest mapping recipients to tag IDs
+// is written beside out, at ManifestPath(out), so it isn't handed out with
+// the copies. The copies made before an error are returned with it.
+func (i *Instance) Distribute(source string, recipients []Recipient, out string) ([]DistributedCopy, error) {
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(source))
+	if ext != ".docx" && ext != ".pdf" {
+		return nil, fmt.Errorf("can't distribute %s files", ext)
+	}
+	dest, err := newCopyWriter(out)
+	if err != nil {
+		return nil, err
+	}
+	// every copy is of the same file, so it is inspected once
+	base := i.describe(source, data)
+	stem := strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))
+	used := make(map[string]int)
+	var copies []DistributedCopy
+	for _, r := range recipients {
+		slug := r.slug()
+		if slug == "" {
+			slug = "recipient"
+		}
+		used[slug]++
+		if n := used[slug]; n > 1 {
+			slug = fmt.Sprintf("%s-%d", slug, n)
+		}
+		name := fmt.Sprintf("%s_%s%s", stem, slug, filepath.Ext(source))
+
+		t := base
+		t.Recipient = r.String()
+		// the watermark may name the recipient
+		i.issue(&t)
+		var tagged []byte
+		if ext == ".pdf" {
+			tagged, err = i.tagPDF(&t, data, name)
+		} else {
+			if tagged, err = i.tagWord(&t); err == nil {
+				err = i.QueueTag(t)
+			}
+		}
+		if err == nil {
+			err = dest.Write(name, tagged)
+		}
+		if err != nil {
+			dest.Close()
+			return copies, fmt.Errorf("copy for %s: %w", r, err)
+		}
+		i.Logger.Printf("Tagged copy %s for %s as %s", name, r, t.ID)
+		if dest.zip == nil {
+			i.recordOutput(t.ID, filepath.Join(out, name))
+		} else {
+			i.recordOutput(t.ID, out)
+		}
+		copies = append(copies, DistributedCopy{Recipient: r, Tag: t, Name: name})
+	}
+	if err := dest.Close(); err != nil {
+		return copies, err
+	}
+	return copies, os.WriteFile(ManifestPath(out), manifest(copies), 0600)
+}
+
+// ManifestPath is where Distribute records which copy went to whom.
+func ManifestPath(out string) string {
+	return filepath.Clean(out) + ".manifest.csv"
+}
+
+func manifest(copies []DistributedCopy) []byte {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write([]string{"name", "email", "organization", "tag_id", "file"})
+	for _, c := range copies {
+		w.Write([]string{c.Recipient.Name, c.Recipient.Email, c.Recipient.Organization, c.Tag.ID, c.Name})
+	}
+	w.Flush()
+	return []byte(b.String())
+}
+
+// copyWriter puts distributed copies in a directory or a zip file.
+type copyWriter struct {
+	dir  string
+	file *os.File
+	zip  *zip.Writer
+}
+
+func newCopyWriter(out string) (*copyWriter, error) {
+	if strings.EqualFold(filepath.Ext(out), ".zip") {
+		f, err := os.Create(out)
+		if err != nil {
+			return nil, err
+		}
+		return &copyWriter{file: f, zip: zip.NewWriter(f)}, nil
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return nil, err
+	}
+	return &copyWriter{dir: out}, nil
+}
+
+func (c *copyWriter) Write(name string, data []byte) error {
+	if c.zip == nil {
+		return os.WriteFile(filepath.Join(c.dir, name), data, 0644)
+	}
+	w, err := c.zip.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (c *copyWriter) Close() error {
+	if c.zip == nil {
+		return nil
+	}
+	if err := c.zip.Close(); err != nil {
+		c.file.Close()
+		return err
+	}
+	return c.file.Close()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// MaxExtractSize caps how much text is pulled out of one document.
+const MaxExtractSize = 16 << 20
+
+// ExtractText returns the readable text of a document whose contents are
+// data. Word, Excel and PDF files are unpacked; anything else is treated as
+// plain text.
+func ExtractText(path string, data []byte) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".docx":
+		return extractOOXML(data, isWordTextPart, "t")
+	case ".xlsx":
+		return extractOOXML(data, isExcelTextPart, "t", "v")
+	case ".pdf":
+		return extractPDF(data), nil
+	default:
+		if len(data) > MaxExtractSize {
+			data = data[:MaxExtractSize]
+		}
+		return string(data), nil
+	}
+}
+
+// isWordTextPart selects the body, headers, footers, notes and comments.
+func isWordTextPart(name string) bool {
+	if !strings.HasPrefix(name, "word/") || !strings.HasSuffix(name, ".xml") {
+		return false
+	}
+	base := strings.TrimSuffix(filepath.Base(name), ".xml")
+	for _, p := range []string{"document", "header", "footer", "footnotes", "endnotes", "comments"} {
+		if strings.HasPrefix(base, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExcelTextPart selects shared strings and sheets, which hold numbers
+// and inline strings.
+func isExcelTextPart(name string) bool {
+	return name == "xl/sharedStrings.xml" ||
+		strings.HasPrefix(name, "xl/worksheets/") && strings.HasSuffix(name, ".xml")
+}
+
+// extractOOXML collects the character data of the named elements in the
+// selected parts of an Office Open XML package, a line per paragraph or
+// cell.
+func extractOOXML(data []byte, part func(string) bool, elements ...string) (string, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	files := append([]*zip.File(nil), r.File...)
+	sort.SliceStable(files, func(a, b int) bool { return files[a].Name < files[b].Name })
+	want := make(map[string]bool)
+	for _, e := range elements {
+		want[e] = true
+	}
+	var b strings.Builder
+	for _, f := range files {
+		if !part(f.Name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		err = xmlText(io.LimitReader(rc, MaxExtractSize), want, &b)
+		rc.Close()
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", f.Name, err)
+		}
+		if b.Len() > MaxExtractSize {
+			break
+		}
+	}
+	return b.String(), nil
+}
+
+func xmlText(r io.Reader, want map[string]bool, b *strings.Builder) error {
+	d := xml.NewDecoder(r)
+	inside := 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if want[t.Name.Local] {
+				inside++
+			}
+		case xml.EndElement:
+			switch {
+			case want[t.Name.Local]:
+				inside--
+			case t.Name.Local == "p" || t.Name.Local == "c" || t.Name.Local == "si":
+				// paragraph, cell or shared string: keep matches from
+				// running into each other
+				b.WriteByte('\n')
+			case t.Name.Local == "tab":
+				b.WriteByte('\t')
+			}
+		case xml.CharData:
+			if inside > 0 {
+				b.Write(t)
+			}
+		}
+	}
+}
+
+var (
+	pdfStream = regexp.MustCompile(`(?s)stream\r?\n(.*?)\r?\nendstream`)
+	pdfText   = regexp.MustCompile(`\((?:[^()\\]|\\.)*\)\s*(?:Tj|'|")|\[(?:[^\[\]\\]|\\.)*\]\s*TJ`)
+	pdfString = regexp.MustCompile(`\((?:[^()\\]|\\.)*\)`)
+)
+
+// pdfStreams returns the contents of the streams in a PDF, inflated when
+// they are Flate encoded, up to MaxExtractSize in all.
+func pdfStreams(data []byte) [][]byte {
+	var out [][]byte
+	total := 0
+	for _, m := range pdfStream.FindAllSubmatch(data, -1) {
+		content := m[1]
+		if zr, err := zlib.NewReader(bytes.NewReader(content)); err == nil {
+			inflated, err := io.ReadAll(io.LimitReader(zr, int64(MaxExtractSize-total)))
+			zr.Close()
+			if err != nil && len(inflated) == 0 {
+				continue
+			}
+			content = inflated
+		}
+		out = append(out, content)
+		if total += len(content); total >= MaxExtractSize {
+			break
+		}
+	}
+	return out
+}
+
+// extractPDF is a best effort text extractor: it inflates the content
+// streams and collects the literal strings drawn by the text operators.
+// Text in hex strings or custom font encodings is not recovered.
+func extractPDF(data []byte) string {
+	var b strings.Builder
+	for _, content := range pdfStreams(data) {
+		for _, op := range pdfText.FindAll(content, -1) {
+			for _, s := range pdfString.FindAll(op, -1) {
+				b.WriteString(unescapePDF(s[1 : len(s)-1]))
+			}
+			b.WriteByte('\n')
+		}
+		if b.Len() > MaxExtractSize {
+			break
+		}
+	}
+	return b.String()
+}
+
+func unescapePDF(s []byte) string {
+	var b strings.Builder
+	for k := 0; k < len(s); k++ {
+		if s[k] != '\\' || k+1 == len(s) {
+			b.WriteByte(s[k])
+			continue
+		}
+		k++
+		switch c := s[k]; c {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '\n':
+			// line continuation
+		default:
+			if c >= '0' && c <= '7' {
+				v := 0
+				for n := 0; n < 3 && k < len(s) && s[k] >= '0' && s[k] <= '7'; n++ {
+					v = v*8 + int(s[k]-'0')
+					k++
+				}
+				k--
+				b.WriteByte(byte(v))
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package main
+
+import "os"
+
+// Only the permission bits are carried over to rewritten files on these
+// systems.
+
+func copyOwner(src os.FileInfo, dst string) {}
+
+func copyXattrs(src, dst string) {}
+
+func syncDir(dir string) {}
@@ -0,0 +1,64 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyOwner gives dst the owner and group of the file described by src.
+// Only root may give files away, so failures are ignored.
+func copyOwner(src os.FileInfo, dst string) {
+	if st, ok := src.Sys().(*syscall.Stat_t); ok {
+		os.Lchown(dst, int(st.Uid), int(st.Gid))
+	}
+}
+
+// copyXattrs copies the extended attributes of src to dst, skipping the
+// ones dst's file system or the user's privileges don't allow.
+func copyXattrs(src, dst string) {
+	size, err := unix.Listxattr(src, nil)
+	if err != nil || size == 0 {
+		return
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Listxattr(src, buf); err != nil {
+		return
+	}
+	for _, name := range splitNull(buf[:size]) {
+		n, err := unix.Getxattr(src, name, nil)
+		if err != nil {
+			continue
+		}
+		val := make([]byte, n)
+		if n, err = unix.Getxattr(src, name, val); err != nil {
+			continue
+		}
+		unix.Setxattr(dst, name, val[:n], 0)
+	}
+}
+
+func splitNull(b []byte) []string {
+	var names []string
+	start := 0
+	for k, c := range b {
+		if c == 0 {
+			if k > start {
+				names = append(names, string(b[start:k]))
+			}
+			start = k + 1
+		}
+	}
+	return names
+}
+
+// syncDir flushes a rename in dir to disk.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
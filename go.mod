@@ -6,8 +6,10 @@ require (
 	fyne.io/fyne v1.4.3
 	fyne.io/fyne/v2 v2.5.5
 	github.com/beevik/etree v1.5.0
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/google/uuid v1.1.2
 	github.com/quic-go/quic-go v0.50.1
+	golang.org/x/sys v0.30.0
 )
 
 require (
@@ -15,7 +17,6 @@ require (
 	github.com/BurntSushi/toml v1.4.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fredbi/uri v1.1.0 // indirect
-	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/fyne-io/gl-js v0.0.0-20220119005834-d2da28d9ccfe // indirect
 	github.com/fyne-io/glfw-js v0.0.0-20241126112943-313d8a0fe1d0 // indirect
 	github.com/fyne-io/image v0.0.0-20220602074514-4956b0afb3d2 // indirect
@@ -47,7 +48,6 @@ require (
 	golang.org/x/mod v0.18.0 // indirect
 	golang.org/x/net v0.35.0 // indirect
 	golang.org/x/sync v0.11.0 // indirect
-	golang.org/x/sys v0.30.0 // indirect
 	golang.org/x/text v0.22.0 // indirect
 	golang.org/x/tools v0.22.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"archive/zip"
 	"bytes"
 	"context"
 	"crypto/sha256"
@@ -9,17 +8,17 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"mime"
+	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"strings"
 	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/dialog"
-	"github.com/beevik/etree"
 	"github.com/quic-go/quic-go"
 )
 
@@ -46,216 +45,51 @@ func CalculateSHA256(filePath string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func addLineToWordDocument(filePath, newLine string) error {
-	r, err := zip.OpenReader(filePath)
-	if err != nil {
-		return err
-	}
-	defer r.Close()
-
-	var documentXML string
-	for _, f := range r.File {
-		if f.Name == "word/document.xml" {
-			rc, err := f.Open()
-			if err != nil {
-				return err
-			}
-			data, err := io.ReadAll(rc)
-			if err != nil {
-				return err
-			}
-			documentXML = string(data)
-			rc.Close()
-			break
-		}
-	}
-
-	if documentXML == "" {
-		return fmt.Errorf("document.xml not found")
-	}
-
-	bodyEnd := "</w:body>"
-	insertPos := strings.LastIndex(documentXML, bodyEnd)
-
-	if insertPos == -1 {
-		return fmt.Errorf("</w:body> tag not found")
-	}
-
-	updatedXML := documentXML[:insertPos] + newLine + documentXML[insertPos:]
-
-	buf := new(bytes.Buffer)
-	w := zip.NewWriter(buf)
-
-	for _, f := range r.File {
-		fw, err := w.Create(f.Name)
-		if err != nil {
-			return err
-		}
-		rc, err := f.Open()
-		if err != nil {
-			return err
-		}
-		_, err = io.Copy(fw, rc)
-		if err != nil {
-			return err
-		}
-		rc.Close()
-	}
-
-	fw, err := w.Create("word/document.xml")
-	if err != nil {
-		return err
-	}
-
-	_, err = fw.Write([]byte(updatedXML))
-	if err != nil {
-		return err
-	}
-
-	w.Close()
-
-	outFile, err := os.Create(filePath)
-	if err != nil {
-		return err
-	}
-	defer outFile.Close()
-
-	_, err = io.Copy(outFile, buf)
-	return err
+func HashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
-func (i *Instance) addRemoteImageTrackerToWordDocument(filePath, trackerURL string, id string) (Tag, error) {
-	// Open the .docx file (ZIP archive)
-	r, err := zip.OpenReader(filePath)
-	if err != nil {
-		return Tag{}, err
-	}
-	defer r.Close()
-
-	var documentXML string
-	for _, f := range r.File {
-		if f.Name == "word/document.xml" {
-			rc, err := f.Open()
-			if err != nil {
-				return Tag{}, err
-			}
-			data, err := io.ReadAll(rc)
-			if err != nil {
-				return Tag{}, err
-			}
-			documentXML = string(data)
-			rc.Close()
-			break
-		}
-	}
+var officeTypes = map[string]string{
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".doc":  "application/msword",
+	".pdf":  "application/pdf",
+}
 
-	if documentXML == "" {
-		fmt.Println("document.xml not found")
-		return Tag{}, fmt.Errorf("document.xml not found")
+// DetectMIME names the type of a file from its extension, falling back to
+// sniffing data. Office types are listed explicitly since the system mime
+// tables often lack them.
+func DetectMIME(path string, data []byte) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if t, ok := officeTypes[ext]; ok {
+		return t
 	}
-
-	doc := etree.NewDocument()
-	if err := doc.ReadFromString(documentXML); err != nil {
-		fmt.Println("Error parsing XML:", err)
-		return Tag{}, err
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
 	}
-	fmt.Println("Parsed XML successfully")
-	elements := doc.FindElements("//w:instrText")
-	for _, e := range elements {
-		contains := strings.Contains(e.Text(), "INCLUDEPICTURE")
-		if contains {
-			nid, ok := extractUUIDFromText(e.Text())
-			if ok {
-				fmt.Println("Found UUID:", nid)
-				return Tag{ID: nid, FilePath: filePath}, nil
-			}
-		}
-	}
-
-	var t Tag
-	t.FilePath = filePath
-	t.ID = id
-	t.Created = int(time.Now().Unix())
-
-	// Construct the field code
-	fieldCode := fmt.Sprintf(`
-    <w:p>
-        <w:r>
-            <w:fldChar w:fldCharType="begin"/>
-        </w:r>
-        <w:r>
-            <w:instrText xml:space="preserve">INCLUDEPICTURE "%s" \d</w:instrText>
-        </w:r>
-        <w:r>
-            <w:fldChar w:fldCharType="separate"/>
-        </w:r>
-        <w:r>
-            <w:t> </w:t>
-        </w:r>
-        <w:r>
-            <w:fldChar w:fldCharType="end"/>
-        </w:r>
-    </w:p>`, trackerURL)
-
-	// Insert the field code before </w:body>
-	bodyEnd := "</w:body>"
-	insertPos := strings.LastIndex(documentXML, bodyEnd)
-	if insertPos == -1 {
-		fmt.Println("</w:body> tag not found")
-		return Tag{}, fmt.Errorf("</w:body> tag not found")
-	}
-	updatedXML := documentXML[:insertPos] + fieldCode + documentXML[insertPos:]
+	return http.DetectContentType(data)
+}
 
-	// Create new ZIP in memory
-	buf := new(bytes.Buffer)
-	w := zip.NewWriter(buf)
-	for _, f := range r.File {
-		fw, err := w.Create(f.Name)
-		if err != nil {
-			fmt.Println("Error creating file in ZIP:", err)
-			return Tag{}, err
-		}
-		rc, err := f.Open()
-		if err != nil {
-			fmt.Println("Error opening file in ZIP:", err)
-			return Tag{}, err
-		}
-		if f.Name == "word/document.xml" {
-			_, err = fw.Write([]byte(updatedXML))
-		} else {
-			_, err = io.Copy(fw, rc)
+// offerSave prompts the user for where to save a tagged copy and calls
+// done with the chosen path.
+func (i *Instance) offerSave(data []byte, done func(string, error)) {
+	dialog.ShowFileSave(func(writer fyne.URIWriteCloser, err error) {
+		if err == nil && writer == nil {
+			err = ErrSaveCancelled
 		}
 		if err != nil {
-			fmt.Println("Error writing file to ZIP:", err)
-			return Tag{}, err
-		}
-		rc.Close()
-	}
-
-	// Finalize ZIP
-	if err := w.Close(); err != nil {
-		return Tag{}, err
-	}
-	fmt.Println("dialog should open?")
-	// Prompt user to save the file
-	dialog.ShowFileSave(func(writer fyne.URIWriteCloser, err error) {
-		if err != nil || writer == nil {
-			i.Logger.Println("File save dialog canceled or failed:", err)
+			done("", err)
 			return
 		}
 		defer writer.Close()
-		// Ensure buffer is reset to start
-		reader := bytes.NewReader(buf.Bytes())
-		n, err := io.Copy(writer, reader)
-		if err != nil {
-			i.Logger.Println("Failed to save file:", err)
+		if _, err := io.Copy(writer, bytes.NewReader(data)); err != nil {
+			done("", err)
 			return
 		}
-		i.Logger.Printf("File saved successfully to %s (%d bytes written)", writer.URI().String(), n)
+		done(writer.URI().Path(), nil)
 	}, i.Window)
-	fmt.Println("dialog should open?")
-
-	return t, nil
 }
 
 func GetUsername() (string, error) {
@@ -270,20 +104,17 @@ func GetUsername() (string, error) {
 	return currentUser.Username, nil // Unix-like systems
 }
 
-func generateMetadata(filePath string, documentType string) map[string]string {
-	metadata := make(map[string]string)
-
-	// Add basic metadata. Enhance this with actual metadata extraction.
-	metadata["filename"] = filepath.Base(filePath)
-	metadata["type"] = documentType
-
-	fileInfo, err := os.Stat(filePath)
-	if err == nil {
-		metadata["size"] = fmt.Sprintf("%d bytes", fileInfo.Size())
+// GetClientID identifies this machine and user to the server.
+func GetClientID() (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
 	}
-
-	//Add further meta data as needed.
-	return metadata
+	uname, err := GetUsername()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s@%s", uname, host), nil
 }
 
 type Tag struct {
@@ -291,23 +122,26 @@ type Tag struct {
 	FilePath string `json:"file_path"`
 	ID       string `json:"id"`
 	ClientID string `json:"client_id"`
-	Hash     string `json:"hash"`
 	URL      string `json:"url"`
 	Created  int    `json:"created"`
-}
-
-func extractUUIDFromText(text string) (string, bool) {
-	// Regular expression for UUID (version 4)
-	uuidRegex := regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}`)
-
-	// Find the first UUID in the text
-	uuidMatch := uuidRegex.FindString(text)
-
-	if uuidMatch != "" {
-		return uuidMatch, true
-	}
-
-	return "", false // UUID not found
+	Revoked  bool   `json:"revoked,omitempty"` // set by the server, see RevokeTag
+
+	OriginalHash string `json:"original_hash"` // SHA-256 of the file as dropped
+	TaggedHash   string `json:"tagged_hash"`   // SHA-256 of the copy carrying the beacon
+	Size         int64  `json:"size"`          // size of the tagged copy
+	MIMEType     string `json:"mime_type"`
+	ParentID     string `json:"parent_id,omitempty"` // tag already in the file when it was tagged
+	Recipient    string `json:"recipient,omitempty"` // who this copy was sent to, see Distribute
+
+	Classification Level     `json:"classification,omitempty"` // level of Label
+	Label          string    `json:"label,omitempty"`          // classification label written into the document
+	Marking        string    `json:"marking,omitempty"`        // visible header or footer text, if any
+	Watermark      string    `json:"watermark,omitempty"`      // visible diagonal text, see WatermarkConfig
+	Findings       []Finding `json:"findings,omitempty"`       // from content inspection
+
+	PublicKey       string `json:"public_key,omitempty"`       // device key that signed the tag
+	Signature       string `json:"signature,omitempty"`        // compact token, see SignTag
+	BeaconSignature string `json:"beacon_signature,omitempty"` // carried by the beacon, see SignBeacon
 }
 
 func dialQUIC(url string, sm *SecretManager) (quic.Connection, quic.Stream, error) {
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rexlx/dlpeagle/internal/frame"
+)
+
+// HistoryEntry is a notification as stored on disk.
+type HistoryEntry struct {
+	Notification
+	Received time.Time `json:"received"`
+	Acked    bool      `json:"acked"`
+}
+
+// historyRecord is one line of the journal. Op is "add" or "ack".
+type historyRecord struct {
+	Op    string        `json:"op"`
+	ID    string        `json:"id,omitempty"`
+	Entry *HistoryEntry `json:"entry,omitempty"`
+}
+
+// History is an append-only JSONL journal of received notifications. Adds
+// and acknowledgements are appended; the file is rewritten only when it has
+// grown well past the retention limits.
+type History struct {
+	path       string
+	mu         sync.Mutex
+	entries    []HistoryEntry // oldest first
+	index      map[string]int
+	records    int
+	MaxEntries int
+	MaxAge     time.Duration
+}
+
+func DefaultHistoryPath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "notifications.jsonl"), nil
+}
+
+// OpenHistory replays the journal at path, creating it if needed.
+func OpenHistory(path string) (*History, error) {
+	h := &History{
+		path:       path,
+		index:      make(map[string]int),
+		MaxEntries: 5000,
+		MaxAge:     90 * 24 * time.Hour,
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), frame.MaxSize)
+	for sc.Scan() {
+		var rec historyRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			// a torn final line from a crash shouldn't lose the rest
+			continue
+		}
+		h.records++
+		h.apply(rec)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	h.prune()
+	return h, nil
+}
+
+func (h *History) apply(rec historyRecord) {
+	switch rec.Op {
+	case "add":
+		if rec.Entry == nil {
+			return
+		}
+		if _, ok := h.index[rec.Entry.ID]; ok {
+			return
+		}
+		h.index[rec.Entry.ID] = len(h.entries)
+		h.entries = append(h.entries, *rec.Entry)
+	case "ack":
+		if k, ok := h.index[rec.ID]; ok {
+			h.entries[k].Acked = true
+		}
+	}
+}
+
+// Add stores n unless a notification with the same ID is already known. It
+// reports whether n was new.
+func (h *History) Add(n Notification) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.index[n.ID]; ok {
+		return false, nil
+	}
+	rec := historyRecord{Op: "add", Entry: &HistoryEntry{Notification: n, Received: time.Now()}}
+	if err := h.append(rec); err != nil {
+		return false, err
+	}
+	h.apply(rec)
+	h.prune()
+	return true, h.maybeCompact()
+}
+
+// Has reports whether a notification with this ID is already stored.
+func (h *History) Has(id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.index[id]
+	return ok
+}
+
+// Ack marks a notification as seen.
+func (h *History) Ack(id string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k, ok := h.index[id]
+	if !ok || h.entries[k].Acked {
+		return nil
+	}
+	rec := historyRecord{Op: "ack", ID: id}
+	if err := h.append(rec); err != nil {
+		return err
+	}
+	h.apply(rec)
+	return nil
+}
+
+// Page returns up to limit entries, newest first, skipping offset of them.
+func (h *History) Page(offset, limit int, unackedOnly bool) []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []HistoryEntry
+	for k := len(h.entries) - 1; k >= 0 && len(out) < limit; k-- {
+		e := h.entries[k]
+		if unackedOnly && e.Acked {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func (h *History) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.entries)
+}
+
+func (h *History) Unacked() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, e := range h.entries {
+		if !e.Acked {
+			n++
+		}
+	}
+	return n
+}
+
+func (h *History) append(rec historyRecord) error {
+	out, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(out, '\n')); err != nil {
+		return err
+	}
+	h.records++
+	return nil
+}
+
+// prune drops entries beyond the retention window from memory. They stay
+// in the journal until the next compaction.
+func (h *History) prune() {
+	drop := 0
+	if h.MaxEntries > 0 && len(h.entries) > h.MaxEntries {
+		drop = len(h.entries) - h.MaxEntries
+	}
+	if h.MaxAge > 0 {
+		cutoff := time.Now().Add(-h.MaxAge)
+		for drop < len(h.entries) && h.entries[drop].Received.Before(cutoff) {
+			drop++
+		}
+	}
+	if drop == 0 {
+		return
+	}
+	h.entries = append([]HistoryEntry(nil), h.entries[drop:]...)
+	h.index = make(map[string]int, len(h.entries))
+	for k, e := range h.entries {
+		h.index[e.ID] = k
+	}
+}
+
+// maybeCompact rewrites the journal once it holds twice as many records as
+// there are live entries.
+func (h *History) maybeCompact() error {
+	if h.records < 2*h.MaxEntries || h.records < 2*len(h.entries) {
+		return nil
+	}
+	tmp := h.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for k := range h.entries {
+		if err := enc.Encode(historyRecord{Op: "add", Entry: &h.entries[k]}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		return err
+	}
+	h.records = len(h.entries)
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Inbox lists leak alerts received from the server and tracks which ones
+// the user has looked at.
+type Inbox struct {
+	instance *Instance
+	app      fyne.App
+	list     *widget.List
+	filter   *widget.Entry
+	mu       sync.Mutex
+	shown    []Notification
+	unread   map[string]bool
+	// OnUnreadChange is called with the new count whenever it changes.
+	OnUnreadChange func(int)
+	// OnOpen is called when the user asks for the inbox from the tray.
+	OnOpen func()
+}
+
+func NewInbox(i *Instance, a fyne.App) *Inbox {
+	b := &Inbox{
+		instance: i,
+		app:      a,
+		unread:   make(map[string]bool),
+	}
+	if i.History != nil {
+		for _, e := range i.History.Page(0, i.History.MaxEntries, true) {
+			b.unread[e.ID] = true
+		}
+	}
+	b.filter = widget.NewEntry()
+	b.filter.SetPlaceHolder("Filter by tag or document")
+	b.filter.OnChanged = func(string) { b.refresh() }
+	b.list = widget.NewList(
+		func() int {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			return len(b.shown)
+		},
+		func() fyne.CanvasObject {
+			return container.NewVBox(widget.NewLabel(""), widget.NewLabel(""))
+		},
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			b.mu.Lock()
+			if id >= len(b.shown) {
+				b.mu.Unlock()
+				return
+			}
+			n := b.shown[id]
+			unread := b.unread[n.ID]
+			b.mu.Unlock()
+			rows := o.(*fyne.Container).Objects
+			title := rows[0].(*widget.Label)
+			title.SetText(b.title(n))
+			title.TextStyle = fyne.TextStyle{Bold: unread}
+			title.Refresh()
+			rows[1].(*widget.Label).SetText(fmt.Sprintf("%s  %s", n.Time, n.IP))
+		},
+	)
+	b.list.OnSelected = func(id widget.ListItemID) {
+		b.mu.Lock()
+		if id >= len(b.shown) {
+			b.mu.Unlock()
+			return
+		}
+		n := b.shown[id]
+		b.mu.Unlock()
+		b.markRead(n.ID)
+		b.showDetail(n)
+		b.list.UnselectAll()
+	}
+	b.refresh()
+	return b
+}
+
+// Widget returns the inbox panel for embedding in the main window.
+func (b *Inbox) Widget() fyne.CanvasObject {
+	return container.NewBorder(b.filter, nil, nil, nil, b.list)
+}
+
+// Notify adds a freshly received alert and raises a desktop notification.
+func (b *Inbox) Notify(n Notification) {
+	b.app.SendNotification(fyne.NewNotification("Document opened: "+b.title(n), b.summary(n)))
+	b.Add(n)
+}
+
+// Add lists a freshly received alert as unread without raising a desktop
+// notification.
+func (b *Inbox) Add(n Notification) {
+	b.mu.Lock()
+	b.unread[n.ID] = true
+	b.mu.Unlock()
+	b.refresh()
+	b.unreadChanged()
+}
+
+func (b *Inbox) Unread() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.unread)
+}
+
+func (b *Inbox) markRead(id string) {
+	b.mu.Lock()
+	_, ok := b.unread[id]
+	delete(b.unread, id)
+	b.mu.Unlock()
+	b.instance.AckNotification(id)
+	if ok {
+		b.list.Refresh()
+		b.unreadChanged()
+	}
+}
+
+func (b *Inbox) unreadChanged() {
+	if b.OnUnreadChange != nil {
+		b.OnUnreadChange(b.Unread())
+	}
+}
+
+// refresh re-applies the filter to the instance's notifications, newest first.
+func (b *Inbox) refresh() {
+	q := strings.ToLower(strings.TrimSpace(b.filter.Text))
+	b.instance.Memory.RLock()
+	all := make([]Notification, 0, len(b.instance.Notifications))
+	for k := len(b.instance.Notifications) - 1; k >= 0; k-- {
+		all = append(all, b.instance.Notifications[k])
+	}
+	b.instance.Memory.RUnlock()
+
+	shown := all[:0]
+	for _, n := range all {
+		if q == "" || strings.Contains(strings.ToLower(n.TagID), q) ||
+			strings.Contains(strings.ToLower(b.title(n)), q) {
+			shown = append(shown, n)
+		}
+	}
+	b.mu.Lock()
+	b.shown = shown
+	b.mu.Unlock()
+	b.list.Refresh()
+}
+
+// title names the document an alert is about, falling back to the tag ID
+// when we never tagged it from this machine.
+func (b *Inbox) title(n Notification) string {
+	if t, ok := b.instance.LookupTag(n.TagID); ok && t.FilePath != "" {
+		return filepath.Base(t.FilePath)
+	}
+	if n.TagID != "" {
+		return n.TagID
+	}
+	return n.Info
+}
+
+func (b *Inbox) summary(n Notification) string {
+	s := fmt.Sprintf("Beacon fired at %s", n.Time)
+	if n.IP != "" {
+		s += " from " + n.IP
+	}
+	return s
+}
+
+func (b *Inbox) showDetail(n Notification) {
+	form := widget.NewForm(
+		widget.NewFormItem("Time", widget.NewLabel(n.Time)),
+		widget.NewFormItem("IP", widget.NewLabel(n.IP)),
+		widget.NewFormItem("User agent", widget.NewLabel(n.UserAgent)),
+		widget.NewFormItem("Info", widget.NewLabel(n.Info)),
+		widget.NewFormItem("Tag", widget.NewLabel(n.TagID)),
+	)
+	if t, ok := b.instance.LookupTag(n.TagID); ok {
+		form.Append("Document", widget.NewLabel(t.FilePath))
+		form.Append("Tagged by", widget.NewLabel(t.Username))
+		if t.Recipient != "" {
+			form.Append("Sent to", widget.NewLabel(t.Recipient))
+		}
+		form.Append("Type", widget.NewLabel(t.MIMEType))
+		if t.Label != "" {
+			in := Inspection{Findings: t.Findings}
+			form.Append("Classification", widget.NewLabel(fmt.Sprintf("%s (%s)", t.Label, in.Summary())))
+		}
+		if t.Watermark != "" {
+			form.Append("Watermark", widget.NewLabel(t.Watermark))
+		}
+		form.Append("Original hash", widget.NewLabel(t.OriginalHash))
+		form.Append("Tagged hash", widget.NewLabel(t.TaggedHash))
+		if t.ParentID != "" {
+			form.Append("Derived from", widget.NewLabel(t.ParentID))
+		}
+	}
+	if b.instance.Analyzer != nil && n.TagID != "" {
+		// the full timeline comes from the server
+		opens := widget.NewLabel("Loading…")
+		form.Append("Opens", opens)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+			defer cancel()
+			var lines []string
+			for _, r := range b.instance.Analyzer.Timeline(ctx, n.TagID) {
+				where := "internal"
+				if !r.Internal {
+					where = "external"
+				}
+				lines = append(lines, fmt.Sprintf("%s  %s  %s", r.Time, r.IP, where))
+			}
+			opens.SetText(strings.Join(lines, "\n"))
+		}()
+	}
+	dialog.ShowCustom("Leak alert", "Close", form, b.instance.Window)
+}
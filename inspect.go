@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Level is how sensitive a document is, from the most sensitive rule that
+// matched it.
+type Level string
+
+const (
+	LevelPublic       Level = "public"
+	LevelInternal     Level = "internal"
+	LevelConfidential Level = "confidential"
+	LevelRestricted   Level = "restricted"
+)
+
+var levelRank = map[Level]int{LevelPublic: 0, LevelInternal: 1, LevelConfidential: 2, LevelRestricted: 3}
+
+// Rule finds one kind of sensitive data. A rule matches by Pattern, by
+// Keywords (whole words, any case) or both; Validator, when set, names a
+// check every pattern match must pass, which keeps e.g. random 16 digit
+// numbers from counting as card numbers.
+type Rule struct {
+	Name      string   `json:"name"`
+	Pattern   string   `json:"pattern,omitempty"`
+	Keywords  []string `json:"keywords,omitempty"`
+	Validator string   `json:"validator,omitempty"` // luhn, ssn or iban
+	Level     Level    `json:"level"`
+
+	re *regexp.Regexp
+}
+
+// InspectionConfig is the rule set in config.json. Rules are added to the
+// built-in ones; Disable turns built-in rules off by name.
+type InspectionConfig struct {
+	Rules    []Rule   `json:"rules,omitempty"`
+	Keywords []string `json:"keywords,omitempty"` // shorthand for a confidential keyword rule
+	Disable  []string `json:"disable,omitempty"`
+}
+
+// DefaultRules are the built-in detectors.
+func DefaultRules() []Rule {
+	return []Rule{
+		{Name: "credit-card", Pattern: `\b(?:\d[ -]?){12,18}\d\b`, Validator: "luhn", Level: LevelRestricted},
+		{Name: "us-ssn", Pattern: `\b\d{3}-\d{2}-\d{4}\b`, Validator: "ssn", Level: LevelRestricted},
+		{Name: "iban", Pattern: `\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,4})?\b`, Validator: "iban", Level: LevelConfidential},
+		{Name: "aws-access-key", Pattern: `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`, Level: LevelRestricted},
+		{Name: "aws-secret-key", Pattern: `(?i)aws_?secret_?(?:access_?)?key\s*[:=]\s*["']?[A-Za-z0-9/+=]{40}\b`, Level: LevelRestricted},
+		{Name: "private-key", Pattern: `-----BEGIN (?:RSA |EC |DSA |OPENSSH |ENCRYPTED )?PRIVATE KEY-----`, Level: LevelRestricted},
+		{Name: "github-token", Pattern: `\b(?:ghp|gho|ghu|ghs|ghr)_[A-Za-z0-9]{36}\b`, Level: LevelRestricted},
+		{Name: "slack-token", Pattern: `\bxox[abprs]-[A-Za-z0-9-]{10,}\b`, Level: LevelRestricted},
+		{Name: "api-key", Pattern: `(?i)\b(?:api[_-]?key|api[_-]?secret|access[_-]?token|secret[_-]?key)\s*[:=]\s*["']?[A-Za-z0-9_\-]{20,}`, Level: LevelConfidential},
+		{Name: "marking", Keywords: []string{"confidential", "internal use only", "do not distribute", "proprietary"}, Level: LevelInternal},
+	}
+}
+
+var validators = map[string]func(string) bool{
+	"luhn": validLuhn,
+	"ssn":  validSSN,
+	"iban": validIBAN,
+}
+
+// Finding is what one rule found in a document. Sample is the first match
+// with all but its last few characters masked, so findings can be stored
+// and sent to the server without leaking what they describe.
+type Finding struct {
+	Rule   string `json:"rule"`
+	Level  Level  `json:"level"`
+	Count  int    `json:"count"`
+	Sample string `json:"sample"`
+}
+
+// Inspection is the result of running the rule set over a document.
+type Inspection struct {
+	Level    Level     `json:"level"`
+	Findings []Finding `json:"findings,omitempty"`
+}
+
+// Summary renders the findings on one line, e.g. "credit-card x3, iban x1".
+func (in Inspection) Summary() string {
+	if len(in.Findings) == 0 {
+		return "nothing found"
+	}
+	parts := make([]string, len(in.Findings))
+	for k, f := range in.Findings {
+		parts[k] = fmt.Sprintf("%s x%d", f.Rule, f.Count)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Inspector runs a compiled rule set.
+type Inspector struct {
+	rules []Rule
+}
+
+func NewInspector(cfg InspectionConfig) (*Inspector, error) {
+	disabled := make(map[string]bool)
+	for _, name := range cfg.Disable {
+		disabled[name] = true
+	}
+	var rules []Rule
+	for _, r := range DefaultRules() {
+		if !disabled[r.Name] {
+			rules = append(rules, r)
+		}
+	}
+	rules = append(rules, cfg.Rules...)
+	if len(cfg.Keywords) > 0 {
+		rules = append(rules, Rule{Name: "keyword", Keywords: cfg.Keywords, Level: LevelConfidential})
+	}
+	for k := range rules {
+		r := &rules[k]
+		if _, ok := levelRank[r.Level]; !ok {
+			return nil, fmt.Errorf("rule %s: unknown level %q", r.Name, r.Level)
+		}
+		if r.Validator != "" && validators[r.Validator] == nil {
+			return nil, fmt.Errorf("rule %s: unknown validator %q", r.Name, r.Validator)
+		}
+		pattern := r.Pattern
+		if len(r.Keywords) > 0 {
+			words := make([]string, len(r.Keywords))
+			for n, w := range r.Keywords {
+				words[n] = regexp.QuoteMeta(w)
+			}
+			kw := `(?i)\b(?:` + strings.Join(words, "|") + `)\b`
+			if pattern != "" {
+				pattern = "(?:" + pattern + ")|" + kw
+			} else {
+				pattern = kw
+			}
+		}
+		if pattern == "" {
+			return nil, fmt.Errorf("rule %s: needs a pattern or keywords", r.Name)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+		r.re = re
+	}
+	return &Inspector{rules: rules}, nil
+}
+
+// Inspect runs every rule over text.
+func (in *Inspector) Inspect(text string) Inspection {
+	res := Inspection{Level: LevelPublic}
+	for _, r := range in.rules {
+		f := Finding{Rule: r.Name, Level: r.Level}
+		for _, m := range r.re.FindAllString(text, -1) {
+			if r.Validator != "" && !validators[r.Validator](m) {
+				continue
+			}
+			if f.Count == 0 {
+				f.Sample = mask(m, r)
+			}
+			f.Count++
+		}
+		if f.Count == 0 {
+			continue
+		}
+		res.Findings = append(res.Findings, f)
+		if levelRank[r.Level] > levelRank[res.Level] {
+			res.Level = r.Level
+		}
+	}
+	sort.SliceStable(res.Findings, func(a, b int) bool {
+		return levelRank[res.Findings[a].Level] > levelRank[res.Findings[b].Level]
+	})
+	return res
+}
+
+// InspectFile extracts the text of the document at path and inspects it.
+func (in *Inspector) InspectFile(path string) (Inspection, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Inspection{}, err
+	}
+	return in.InspectData(path, data)
+}
+
+// InspectData is InspectFile for contents already read.
+func (in *Inspector) InspectData(path string, data []byte) (Inspection, error) {
+	text, err := ExtractText(path, data)
+	if err != nil {
+		return Inspection{}, err
+	}
+	return in.Inspect(text), nil
+}
+
+// mask hides a match, keeping its last four characters. Keyword matches
+// aren't secret and are kept as they are.
+func mask(m string, r Rule) string {
+	if r.Pattern == "" {
+		return m
+	}
+	runes := []rune(m)
+	keep := 4
+	if len(runes) <= 8 {
+		keep = 0
+	}
+	return strings.Repeat("*", len(runes)-keep) + string(runes[len(runes)-keep:])
+}
+
+func digits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+func validLuhn(s string) bool {
+	d := digits(s)
+	if len(d) < 13 || len(d) > 19 {
+		return false
+	}
+	sum := 0
+	for k := 0; k < len(d); k++ {
+		n := int(d[len(d)-1-k] - '0')
+		if k%2 == 1 {
+			n *= 2
+			if n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+	}
+	return sum%10 == 0
+}
+
+// validSSN rejects numbers the SSA never issues.
+func validSSN(s string) bool {
+	d := digits(s)
+	if len(d) != 9 {
+		return false
+	}
+	area, group, serial := d[:3], d[3:5], d[5:]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+// validIBAN checks the ISO 13616 mod 97 checksum.
+func validIBAN(s string) bool {
+	s = strings.ReplaceAll(s, " ", "")
+	if len(s) < 15 || len(s) > 34 {
+		return false
+	}
+	var b strings.Builder
+	for _, c := range s[4:] + s[:4] {
+		switch {
+		case c >= '0' && c <= '9':
+			b.WriteRune(c)
+		case c >= 'A' && c <= 'Z':
+			fmt.Fprintf(&b, "%d", c-'A'+10)
+		default:
+			return false
+		}
+	}
+	n, ok := new(big.Int).SetString(b.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
@@ -1,42 +1,61 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/ed25519"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"fyne.io/fyne/v2"
-	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/widget"
 	"github.com/google/uuid"
 	"github.com/quic-go/quic-go"
+	"github.com/rexlx/dlpeagle/internal/frame"
 )
 
 type Instance struct {
-	Window        fyne.Window     `json:"-"`
-	Storage       Storage         `json:"-"`
-	Memory        *sync.RWMutex   `json:"-"`
-	Notifications []Notification  `json:"notifications"`
-	SM            *SecretManager  `json:"-"`
-	Notifier      SoundBlock      `json:"notifier"`
-	API           API             `json:"api"`
-	Logger        *log.Logger     `json:"-"`
-	Gateway       *http.Client    `json:"-"`
-	QUICConn      quic.Connection `json:"-"`            // QUIC Connection.
-	QUICStream    quic.Stream     `json:"-"`            // QUIC Stream.
-	QUICAddress   string          `json:"quic_address"` // Address of the QUIC server.
-	MessageLabel  *widget.Label   `json:"-"`            // Label to display messages.
+	Window        fyne.Window        `json:"-"`
+	Storage       Storage            `json:"-"`
+	Memory        *sync.RWMutex      `json:"-"`
+	Notifications []Notification     `json:"notifications"`
+	History       *History           `json:"-"`
+	Outbox        *Outbox            `json:"-"`
+	TagDB         *TagDB             `json:"-"`
+	Analyzer      *HitAnalyzer       `json:"-"`
+	Inspector     *Inspector         `json:"-"`
+	Label         string             `json:"label"`     // Classification label to apply, "" picks one from inspection.
+	Marking       bool               `json:"marking"`   // Add the label as a visible header or footer.
+	Watermark     bool               `json:"watermark"` // Add a visible diagonal watermark.
+	Config        Config             `json:"config"`
+	Tags          map[string]Tag     `json:"-"`
+	SM            *SecretManager     `json:"-"`
+	Notifier      SoundBlock         `json:"notifier"`
+	Audio         AudioOutput        `json:"-"`
+	API           API                `json:"api"`
+	Logger        *log.Logger        `json:"-"`
+	Gateway       *http.Client       `json:"-"`
+	Client        *Client            `json:"-"`
+	QUIC          *QUICClient        `json:"-"`            // Notification client.
+	QUICAddress   string             `json:"quic_address"` // Address of the QUIC server.
+	TLS           TLSFiles           `json:"tls"`          // Pinned CA and client keypair.
+	DeviceKey     ed25519.PrivateKey `json:"-"`            // Signs registered tags.
+	MessageLabel  *widget.Label      `json:"-"`            // Label to display messages.
+	// OnRegister is called with the outcome of every attempt to register
+	// a tag.
+	OnRegister func(Tag, error) `json:"-"`
+
+	paused   atomic.Bool
+	enrollMu sync.Mutex
 }
 
 type SecretManager struct {
@@ -53,49 +72,168 @@ type API struct {
 
 func NewInstance(api API, logname *log.Logger, quicAddress string, messageLabel *widget.Label) *Instance {
 	sb := SoundBlockIn880Hz(time.Second)
-	return &Instance{
+	sm := &SecretManager{
+		QC: &quic.Config{
+			KeepAlivePeriod: 15 * time.Second,
+			MaxIdleTimeout:  45 * time.Second,
+		},
+		TC: &tls.Config{NextProtos: []string{frame.ALPN}},
+	}
+	i := &Instance{
 		Memory:        &sync.RWMutex{},
 		Notifications: make([]Notification, 0),
-		SM:            &SecretManager{},
+		Tags:          make(map[string]Tag),
+		SM:            sm,
 		Notifier:      *sb,
+		Audio:         DefaultAudioOutput(),
 		API:           api,
 		Logger:        logname,
-		Gateway:       &http.Client{},
+		Gateway:       &http.Client{Timeout: DefaultTimeout},
 		QUICAddress:   quicAddress,
 		MessageLabel:  messageLabel,
 	}
+	i.Client = NewClient(api, i.Gateway)
+	i.QUIC = NewQUICClient(quicAddress, sm, logname)
+	i.QUIC.Hello = i.hello
+	i.QUIC.OnNotification = func(n Notification, ack func()) {
+		if _, err := i.AddNotification(n); err == nil {
+			ack()
+		}
+	}
+	return i
+}
+
+// hello is the registration message sent to the QUIC server on every connect.
+func (i *Instance) hello() Notification {
+	id, err := GetClientID()
+	if err != nil {
+		i.Logger.Println("Error getting client id:", err)
+	}
+	return Notification{
+		ID:   id,
+		Info: "register",
+		Time: time.Now().Format(time.RFC3339),
+	}
 }
 
+// SendTag registers tag with the server, enrolling first: the server
+// refuses signed tags from a client it hasn't bound a device key to.
 func (i *Instance) SendTag(tag Tag) error {
+	var err error
+	if i.TLS.Cert != "" && tag.Signature != "" {
+		err = i.Enroll(i.TLS)
+	}
+	if err == nil {
+		err = i.Client.RegisterTag(context.Background(), tag)
+	}
+	if i.OnRegister != nil {
+		i.OnRegister(tag, err)
+	}
+	return err
+}
+
+// QueueTag records a new tag locally and hands it to the outbox for
+// delivery. Without an outbox it is sent directly. Callers queue a tag
+// before its tagged copy is written and give up on the copy when this
+// fails, so there is never a beacon the server won't hear about.
+func (i *Instance) QueueTag(t Tag) error {
+	i.RememberTag(t)
+	if i.TagDB != nil {
+		if err := i.TagDB.Put(t); err != nil {
+			i.Logger.Println("Error saving tag:", err)
+		}
+	}
+	if i.Outbox == nil {
+		if err := i.SendTag(t); err != nil {
+			i.Logger.Println("Error sending tag:", err)
+			return err
+		}
+		return nil
+	}
+	if err := i.Outbox.Enqueue(t); err != nil {
+		i.Logger.Println("Error queueing tag:", err)
+		return err
+	}
 	return nil
 }
 
-func (i *Instance) IsConnected() bool {
-	res, err := i.Gateway.Get(fmt.Sprintf("%v/access", i.API.URL))
-	if err != nil {
-		i.Logger.Println("Error checking connection:", err)
-		return false
+// RememberTag keeps tags created this session so alerts can be matched
+// back to the document they concern.
+func (i *Instance) RememberTag(t Tag) {
+	i.Memory.Lock()
+	i.Tags[t.ID] = t
+	i.Memory.Unlock()
+}
+
+// LookupTag finds a tag seen this session or created here earlier.
+func (i *Instance) LookupTag(id string) (Tag, bool) {
+	i.Memory.RLock()
+	t, ok := i.Tags[id]
+	i.Memory.RUnlock()
+	if !ok && i.TagDB != nil {
+		var r TagRecord
+		r, ok = i.TagDB.Get(id)
+		t = r.Tag
 	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		i.Logger.Println("Not connected to the server.")
+	return t, ok
+}
+
+// IsTaggedCopy reports whether hash is that of a tagged copy made on this
+// machine, so a copy isn't tagged again when it lands in a watched folder.
+func (i *Instance) IsTaggedCopy(hash string) bool {
+	if i.TagDB != nil && i.TagDB.HasTaggedHash(hash) {
+		return true
+	}
+	i.Memory.RLock()
+	defer i.Memory.RUnlock()
+	for _, t := range i.Tags {
+		if t.TaggedHash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// recordOutput notes where the tagged copy for tag id was saved.
+func (i *Instance) recordOutput(id, path string) {
+	if i.TagDB == nil {
+		return
+	}
+	if err := i.TagDB.SetOutput(id, path); err != nil {
+		i.Logger.Println("Error saving tag:", err)
+	}
+}
+
+// Paused reports whether alerts are held back: hits are still recorded in
+// the inbox, but without a sound or a desktop notification.
+func (i *Instance) Paused() bool {
+	return i.paused.Load()
+}
+
+func (i *Instance) SetPaused(p bool) {
+	i.paused.Store(p)
+	i.Logger.Println("Alerts paused:", p)
+}
+
+func (i *Instance) IsConnected() bool {
+	if err := i.Client.Ping(context.Background()); err != nil {
+		i.Logger.Println("Not connected to the server:", err)
 		return false
 	}
 	return true
 }
 
-func (i *Instance) inferDocumentType(filePath string) string {
-	ext := strings.ToLower(filepath.Ext(filePath))
-
-	switch ext {
+// documentKind names the kind of document at filePath for display.
+func documentKind(filePath string) string {
+	switch strings.ToLower(filepath.Ext(filePath)) {
 	case ".pdf":
-		i.HandlePDF(filePath)
 		return "PDF"
 	case ".txt":
 		return "Text"
 	case ".docx", ".doc":
-		i.TagWordDocument(filePath)
 		return "Word Document"
+	case ".odt", ".ods", ".odp":
+		return "OpenDocument"
 	case ".jpg", ".jpeg", ".png", ".gif":
 		return "Image"
 	default:
@@ -103,196 +241,241 @@ func (i *Instance) inferDocumentType(filePath string) string {
 	}
 }
 
-func (i *Instance) TagWordDocument(filePath string) {
-	if !FileExists(filePath) {
-		fmt.Println("File does not exist.")
-		return
+// TagFile tags the document at filePath, queues its registration and
+// returns the tag with the tagged copy, which is left for the caller to
+// save.
+func (i *Instance) TagFile(filePath string) (Tag, []byte, error) {
+	switch documentKind(filePath) {
+	case "PDF":
+		return i.TagPDF(filePath)
+	case "Word Document":
+		return i.TagWordDocument(filePath)
+	case "OpenDocument":
+		return i.LabelODF(filePath)
 	}
-	// TODO: should we hash file before and after?
-	id := uuid.New().String()
-	url := fmt.Sprintf("%v/%v", i.API.URL, id)
-	// add the hidden image to the word document
-	t, err := i.addRemoteImageTrackerToWordDocument(filePath, url, id)
-	if err != nil {
-		i.Logger.Println("Error adding line to word document:", err)
-		return
+	return Tag{}, nil, fmt.Errorf("can't tag %s files", documentKind(filePath))
+}
+
+// newTag starts a tag for the file at path whose current contents are data.
+// Only the beacon signature is made here; the tag is signed once its tagged
+// copy exists.
+func (i *Instance) newTag(path string, data []byte) Tag {
+	t := i.describe(path, data)
+	i.issue(&t)
+	return t
+}
+
+// describe fills in what a tag records about the file at path whose current
+// contents are data: its hash, owner, inspection result and label. A tag
+// already embedded in the file becomes the parent. Copies of one file share
+// this, see Distribute.
+func (i *Instance) describe(path string, data []byte) Tag {
+	t := Tag{
+		FilePath:     path,
+		OriginalHash: HashBytes(data),
+		MIMEType:     DetectMIME(path, data),
+		ParentID:     parentTagID(path),
+	}
+	var err error
+	if t.Username, err = GetUsername(); err != nil {
+		i.Logger.Println("Error getting username:", err)
+	}
+	if t.ClientID, err = GetClientID(); err != nil {
+		i.Logger.Println("Error getting client id:", err)
+	}
+	if i.Inspector != nil {
+		if in, err := i.Inspector.InspectData(path, data); err != nil {
+			i.Logger.Println("Error inspecting document:", err)
+		} else {
+			t.Classification, t.Findings = in.Level, in.Findings
+		}
 	}
-	// err = i.SendTag(t)
+	i.applyLabel(&t)
+	return t
+}
+
+// issue gives t a fresh ID and creation time, then the watermark and beacon
+// signature, which may depend on them.
+func (i *Instance) issue(t *Tag) {
+	t.ID = uuid.New().String()
+	t.Created = int(time.Now().Unix())
+	i.applyWatermark(t)
+	i.signBeacon(t)
+}
 
-	hash, err := CalculateSHA256(filePath)
+func (i *Instance) TagWordDocument(filePath string) (Tag, []byte, error) {
+	data, err := os.ReadFile(filePath)
 	if err != nil {
-		i.Logger.Println("Error calculating hash:", err)
-		return
+		return Tag{}, nil, err
 	}
-	t.Hash = hash
-	uname, err := GetUsername()
+	t := i.newTag(filePath, data)
+	tagged, err := i.tagWord(&t)
 	if err != nil {
-		i.Logger.Println("Error getting username:", err)
+		return Tag{}, nil, err
+	}
+	if err := i.QueueTag(t); err != nil {
+		return Tag{}, nil, err
 	}
-	t.Username = uname
-	t.FilePath = filePath
-	out, err := json.Marshal(t)
+	return t, tagged, nil
+}
+
+// tagWord returns a copy of t's Word document carrying its beacon and
+// label, recording the copy's hash and size on t and signing it.
+func (i *Instance) tagWord(t *Tag) ([]byte, error) {
+	tagged, err := beaconWordFile(t.FilePath, i.beaconURL(*t), i.wordBeacons())
 	if err != nil {
-		i.Logger.Println("Error marshalling tag:", err)
-		return
+		return nil, err
+	}
+	if t.Label != "" {
+		if tagged, err = labelDocx(tagged, i.Config.Classification, *t); err != nil {
+			return nil, err
+		}
 	}
-	request, err := http.NewRequest("POST", fmt.Sprintf("%v/tag", i.API.URL), bytes.NewBuffer(out))
+	if t.Watermark != "" {
+		if tagged, err = watermarkDocx(tagged, i.Config.Watermark, *t); err != nil {
+			return nil, err
+		}
+	}
+	t.TaggedHash = HashBytes(tagged)
+	t.Size = int64(len(tagged))
+	i.signTag(t)
+	return tagged, nil
+}
+
+// LabelODF labels an OpenDocument file. There is no beacon for these yet,
+// so the tag only records the labelled copy's hashes.
+func (i *Instance) LabelODF(filePath string) (Tag, []byte, error) {
+	data, err := os.ReadFile(filePath)
 	if err != nil {
-		i.Logger.Println("Error creating request:", err)
-		return
+		return Tag{}, nil, err
 	}
-	request.SetBasicAuth(i.API.Username, i.API.Password)
-	res, err := i.Gateway.Do(request)
+	t := i.newTag(filePath, data)
+	if t.Label == "" {
+		return Tag{}, nil, fmt.Errorf("no classification label for %s", filepath.Base(filePath))
+	}
+	labelled, err := labelODF(data, i.Config.Classification, t)
 	if err != nil {
-		i.Logger.Println("Error sending request:", err)
-		return
+		return Tag{}, nil, err
 	}
-	defer res.Body.Close()
-	status := res.StatusCode
-	if status != http.StatusOK || status != http.StatusCreated {
-		i.Logger.Println("Error sending tag:", status)
-		return
+	t.TaggedHash = HashBytes(labelled)
+	t.Size = int64(len(labelled))
+	i.signTag(&t)
+	if err := i.QueueTag(t); err != nil {
+		return Tag{}, nil, err
 	}
-	i.Logger.Println("Tag sent successfully.")
+	return t, labelled, nil
+}
 
+// AddNotification records a notification received from the server. It
+// returns false for a notification we've already seen, e.g. one redelivered
+// after a reconnect, and an error if the history couldn't save it, in which
+// case it is only kept for this session.
+func (i *Instance) AddNotification(not Notification) (bool, error) {
+	var err error
+	if i.History != nil {
+		var isNew bool
+		if isNew, err = i.History.Add(not); err != nil {
+			i.Logger.Println("Error saving notification:", err)
+		} else if !isNew {
+			return false, nil
+		}
+	}
+	i.Memory.Lock()
+	i.Notifications = append(i.Notifications, not)
+	if i.History != nil && len(i.Notifications) > i.History.MaxEntries {
+		i.Notifications = i.Notifications[len(i.Notifications)-i.History.MaxEntries:]
+	}
+	i.Memory.Unlock()
+	return true, err
 }
 
-func (i *Instance) SendAndReceiveOverQUIC(ctx context.Context, url string, sm *SecretManager, qr *Notification) {
-	out, err := json.Marshal(qr)
-	if err != nil {
-		i.Logger.Println("Error marshalling notification:", err)
-		return
+// SeenNotification reports whether a notification was already received,
+// so a redelivery can be dropped before any work is done for it.
+func (i *Instance) SeenNotification(id string) bool {
+	if i.History != nil {
+		return i.History.Has(id)
 	}
+	i.Memory.RLock()
+	defer i.Memory.RUnlock()
+	for _, n := range i.Notifications {
+		if n.ID == id {
+			return true
+		}
+	}
+	return false
+}
 
-	conn, stream, err := dialQUIC(url, sm)
-	if err != nil {
-		i.Logger.Printf("Failed to dial QUIC: %v", err)
+// AckNotification marks a notification as seen in the history.
+func (i *Instance) AckNotification(id string) {
+	if i.History == nil {
 		return
 	}
-	i.QUICConn = conn
-	i.QUICStream = stream
-	defer func() {
-		if err := i.QUICConn.CloseWithError(0, "terminating"); err != nil {
-			i.Logger.Printf("Error closing QUIC connection: %v", err)
-		}
-		// Stream will be closed automatically by connection closure
-		// If you need explicit stream closure first, do it before CloseWithError
-	}()
-	_, err = stream.Write(out) // this request registers the client
+	if err := i.History.Ack(id); err != nil {
+		i.Logger.Println("Error acknowledging notification:", err)
+	}
+}
+
+// LoadHistory opens the notification history and restores the in-memory
+// list from it.
+func (i *Instance) LoadHistory(path string) error {
+	h, err := OpenHistory(path)
 	if err != nil {
-		i.Logger.Println("Error writing to QUIC stream:", err)
-		return
+		return err
+	}
+	entries := h.Page(0, h.MaxEntries, false)
+	i.Memory.Lock()
+	i.History = h
+	i.Notifications = make([]Notification, 0, len(entries))
+	for k := len(entries) - 1; k >= 0; k-- {
+		i.Notifications = append(i.Notifications, entries[k].Notification)
 	}
+	i.Memory.Unlock()
+	return nil
+}
 
-	buf := make([]byte, 1024)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			n, err := stream.Read(buf)
-			if err != nil {
-				if err == io.EOF {
-					i.Logger.Println("QUIC stream closed by remote")
-					return
-				}
-				i.Logger.Printf("Error reading from QUIC stream: %v", err)
-				return
-			}
-
-			var not Notification
-			if err := json.Unmarshal(buf[:n], &not); err != nil {
-				i.Logger.Println("Error unmarshalling notification:", err)
-				return
-			}
-
-			i.Memory.Lock()
-			i.Notifications = append(i.Notifications, not)
-			i.Memory.Unlock()
-		}
+// Alert plays the pattern for the notification's severity. It blocks until
+// playback finishes.
+func (i *Instance) Alert(not Notification) {
+	wav := PatternWAV(AlertPattern(i.Notifier, not.Severity))
+	if err := i.Audio.Play(wav); err != nil {
+		i.Logger.Println("Error playing alert:", err)
 	}
 }
 
-func (i *Instance) HandlePDF(filePath string) {
+// TagPDF has the server add a beacon to the PDF at filePath.
+func (i *Instance) TagPDF(filePath string) (Tag, []byte, error) {
 	fileData, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		i.Logger.Println("Error reading PDF file:", err)
-		return
+		return Tag{}, nil, err
 	}
-	uname, err := GetUsername()
+	t := i.newTag(filePath, fileData)
+	pdfData, err := i.tagPDF(&t, fileData, filepath.Base(filePath))
 	if err != nil {
-		i.Logger.Println("Error getting username:", err)
+		return Tag{}, nil, err
 	}
-	uid := uuid.New().String()
-	t := Tag{
-		Username: uname,
-		FilePath: filePath,
-		Hash:     "",
-		ID:       uid,
-	}
-	go func() {
-		out, err := json.Marshal(t)
-		if err != nil {
-			i.Logger.Println("Error marshalling tag:", err)
-			return
-		}
-		request, err := http.NewRequest("POST", fmt.Sprintf("%v/tag", i.API.URL), bytes.NewBuffer(out))
-		if err != nil {
-			i.Logger.Println("Error creating request:", err)
-			return
-		}
-		request.SetBasicAuth(i.API.Username, i.API.Password)
-		res, err := i.Gateway.Do(request)
-		if err != nil {
-			i.Logger.Println("Error sending request:", err)
-			return
-		}
-		defer res.Body.Close()
-		status := res.StatusCode
-		if status != http.StatusOK || status != http.StatusCreated {
-			i.Logger.Println("Error sending tag:", status)
-			return
-		}
-		i.Logger.Println("Tag sent successfully.")
-	}()
+	return t, pdfData, nil
+}
 
-	fileName := filepath.Base(filePath)
-	url, err := i.Storage.SavePDF(fileData, fileName, uid)
+// tagPDF has the server add t's beacon to data, uploaded as name, then
+// signs and queues t with the tagged copy's hash and size. It returns the
+// tagged PDF.
+func (i *Instance) tagPDF(t *Tag, data []byte, name string) ([]byte, error) {
+	url, err := i.Storage.SavePDF(data, name, *t)
 	if err != nil {
-		i.Logger.Println("Error saving PDF file:", err)
-		return
+		return nil, err
 	}
 	i.Logger.Println("PDF file saved successfully.")
-	resp, err := http.Get(url)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	pdfData, err := i.Client.Fetch(ctx, url)
 	if err != nil {
-		i.Logger.Println("Error getting PDF file:", err)
-		return
+		return nil, fmt.Errorf("getting tagged pdf: %w", err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		i.Logger.Println("Error getting PDF file:", resp.Status)
-		return
+	t.TaggedHash = HashBytes(pdfData)
+	t.Size = int64(len(pdfData))
+	i.signTag(t)
+	if err := i.QueueTag(*t); err != nil {
+		return nil, err
 	}
-	pdfData, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		i.Logger.Println("Error reading response body:", err)
-		return
-	}
-
-	dialog.ShowFileSave(func(writer fyne.URIWriteCloser, err error) {
-		if err != nil || writer == nil {
-			return
-		}
-		defer writer.Close()
-		_, err = io.Copy(writer, bytes.NewReader(pdfData))
-		if err != nil {
-			i.Logger.Println("Error saving PDF file:", err)
-			return
-		}
-		i.Logger.Println("PDF file saved successfully.")
-	}, i.Window)
-	i.Logger.Println("PDF file downloaded successfully.")
-	i.MessageLabel.SetText("PDF file downloaded successfully.")
-	i.MessageLabel.Refresh()
-	i.MessageLabel.Show()
+	return pdfData, nil
 }
@@ -0,0 +1,140 @@
+// Package frame is the wire format of the QUIC notification channel, shared
+// by the dlpeagle client and dlpeagle-server.
+//
+// Frames on the notification stream are laid out as
+//
+//	version (1 byte) | type (1 byte) | length (4 bytes, big endian) | JSON payload
+//
+// so a reader never has to guess where one message ends and the next begins.
+package frame
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// ALPN is the application protocol negotiated on the channel.
+	ALPN       = "dlpeagle/1"
+	Version    = 1
+	HeaderSize = 6
+	MaxSize    = 1 << 20
+)
+
+type MessageType byte
+
+const (
+	MsgHello        MessageType = 1
+	MsgAck          MessageType = 2
+	MsgNotification MessageType = 3
+	MsgPing         MessageType = 4
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MsgHello:
+		return "hello"
+	case MsgAck:
+		return "ack"
+	case MsgNotification:
+		return "notification"
+	case MsgPing:
+		return "ping"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(t))
+	}
+}
+
+var (
+	ErrVersion = errors.New("unsupported frame version")
+	ErrType    = errors.New("unknown frame type")
+	ErrSize    = errors.New("frame exceeds maximum size")
+)
+
+// Message is a single decoded frame. Payload is left raw so the caller can
+// decide what to unmarshal it into based on Type.
+type Message struct {
+	Type    MessageType
+	Payload json.RawMessage
+}
+
+// Ack confirms receipt of the message with the given ID.
+type Ack struct {
+	ID string `json:"id"`
+}
+
+func (m Message) Decode(v any) error {
+	return json.Unmarshal(m.Payload, v)
+}
+
+// WriteMessage marshals v and writes it to w as one frame.
+func WriteMessage(w io.Writer, t MessageType, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(payload) > MaxSize {
+		return ErrSize
+	}
+	frame := make([]byte, HeaderSize+len(payload))
+	frame[0] = Version
+	frame[1] = byte(t)
+	binary.BigEndian.PutUint32(frame[2:HeaderSize], uint32(len(payload)))
+	copy(frame[HeaderSize:], payload)
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadMessage reads exactly one frame from r. A clean end of stream between
+// frames is reported as io.EOF, a stream cut mid-frame as io.ErrUnexpectedEOF.
+// The payload buffer grows as data arrives, so a header claiming more than
+// the peer sends doesn't cost the claimed size in memory.
+func ReadMessage(r io.Reader) (Message, error) {
+	var hdr [HeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Message{}, err
+	}
+	if hdr[0] != Version {
+		return Message{}, fmt.Errorf("%w: %d", ErrVersion, hdr[0])
+	}
+	t := MessageType(hdr[1])
+	if t < MsgHello || t > MsgPing {
+		return Message{}, fmt.Errorf("%w: %d", ErrType, hdr[1])
+	}
+	n := binary.BigEndian.Uint32(hdr[2:])
+	if n > MaxSize {
+		return Message{}, ErrSize
+	}
+	payload, err := io.ReadAll(io.LimitReader(r, int64(n)))
+	if err != nil {
+		return Message{}, err
+	}
+	if len(payload) < int(n) {
+		return Message{}, io.ErrUnexpectedEOF
+	}
+	if !json.Valid(payload) {
+		return Message{}, fmt.Errorf("invalid %v payload", t)
+	}
+	return Message{Type: t, Payload: payload}, nil
+}
+
+// Writer serialises writes from several goroutines, e.g. a reader loop and
+// a ping ticker, so frames never interleave on the stream.
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (f *Writer) Write(t MessageType, v any) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return WriteMessage(f.w, t, v)
+}
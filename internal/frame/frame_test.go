@@ -0,0 +1,107 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func FuzzReadMessage(f *testing.F) {
+	for _, m := range []struct {
+		t MessageType
+		v any
+	}{
+		{MsgHello, map[string]string{"id": "client", "info": "register"}},
+		{MsgAck, Ack{ID: "42"}},
+		{MsgNotification, map[string]any{"id": "n1", "severity": "high"}},
+		{MsgPing, Ack{}},
+	} {
+		var buf bytes.Buffer
+		if err := WriteMessage(&buf, m.t, m.v); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte{Version, byte(MsgAck), 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{Version, byte(MsgAck), 0, 0x10, 0, 0, '{'})
+	f.Add([]byte{2, byte(MsgAck), 0, 0, 0, 2, '{', '}'})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		if err := WriteMessage(&buf, m.Type, m.Payload); err != nil {
+			t.Fatalf("re-encoding %v: %v", m.Type, err)
+		}
+		again, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatalf("reading re-encoded %v: %v", m.Type, err)
+		}
+		if again.Type != m.Type {
+			t.Fatalf("type %v came back as %v", m.Type, again.Type)
+		}
+		// WriteMessage compacts and escapes the payload, so compare values
+		var want, got any
+		if err := m.Decode(&want); err != nil {
+			t.Fatal(err)
+		}
+		if err := again.Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("payload %s came back as %s", m.Payload, again.Payload)
+		}
+	})
+}
+
+func header(version byte, t MessageType, n uint32) []byte {
+	hdr := []byte{version, byte(t), 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(hdr[2:], n)
+	return hdr
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, io.EOF},
+		{"short header", []byte{Version, byte(MsgAck)}, io.ErrUnexpectedEOF},
+		{"version", append(header(Version+1, MsgAck, 2), "{}"...), ErrVersion},
+		{"type", append(header(Version, 0, 2), "{}"...), ErrType},
+		{"oversized", header(Version, MsgAck, MaxSize+1), ErrSize},
+		{"truncated", append(header(Version, MsgAck, 10), "{}"...), io.ErrUnexpectedEOF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ReadMessage(bytes.NewReader(tc.data))
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("got %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+// A header claiming the maximum size followed by a few bytes must not cost
+// a megabyte.
+func TestReadMessageClaimedSize(t *testing.T) {
+	data := append(header(Version, MsgAck, MaxSize), "{}"...)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for k := 0; k < 10; k++ {
+		if _, err := ReadMessage(bytes.NewReader(data)); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("got %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > MaxSize {
+		t.Fatalf("10 truncated frames allocated %d bytes", n)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// DefaultJobWorkers is how many files are tagged at once.
+const DefaultJobWorkers = 4
+
+// maxJobs is how many jobs the list keeps; the oldest finished ones go
+// first.
+const maxJobs = 200
+
+// Job stages, in order.
+const (
+	JobQueued  = "Queued"
+	JobTagging = "Tagging"
+	JobSaving  = "Saving"
+	JobDone    = "Done"
+	JobFailed  = "Failed"
+)
+
+// Registration states of a job's tag.
+const (
+	RegPending    = "registration pending"
+	RegRegistered = "registered"
+	RegRejected   = "rejected by the server"
+	RegFailed     = "not registered" // followed by the last error
+)
+
+// Job is one dropped file making its way through tagging and saving.
+type Job struct {
+	ID     int
+	Path   string
+	Kind   string
+	Stage  string
+	TagID  string
+	Output string
+	Err    error
+	// Policy overrides the instance's output policy, e.g. for files from
+	// watched folders.
+	Policy *OutputConfig
+}
+
+// progress maps the job's stage onto a progress bar.
+func (j Job) progress() float64 {
+	switch j.Stage {
+	case JobTagging:
+		return 0.3
+	case JobSaving:
+		return 0.7
+	case JobDone, JobFailed:
+		return 1
+	}
+	return 0
+}
+
+// JobQueue tags dropped files on a pool of workers, so the window stays
+// responsive while documents are uploaded and registered, and lists each
+// file's progress.
+type JobQueue struct {
+	instance *Instance
+	workers  int
+	list     *widget.List
+	wake     chan struct{}
+	dirty    chan struct{}
+	mu       sync.Mutex
+	jobs     []*Job
+	todo     []*Job
+	nextID   int
+	regs     map[string]string // tag ID to registration state
+}
+
+func NewJobQueue(i *Instance, workers int) *JobQueue {
+	if workers < 1 {
+		workers = DefaultJobWorkers
+	}
+	q := &JobQueue{
+		instance: i,
+		workers:  workers,
+		wake:     make(chan struct{}, 1),
+		dirty:    make(chan struct{}, 1),
+		regs:     make(map[string]string),
+	}
+	q.list = widget.NewList(
+		func() int {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			return len(q.jobs)
+		},
+		func() fyne.CanvasObject {
+			retry := widget.NewButtonWithIcon("Retry", theme.ViewRefreshIcon(), nil)
+			return container.NewBorder(nil, nil, nil, retry,
+				container.NewVBox(widget.NewLabel(""), widget.NewProgressBar(), widget.NewLabel("")))
+		},
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			q.mu.Lock()
+			if id >= len(q.jobs) {
+				q.mu.Unlock()
+				return
+			}
+			j := *q.jobs[id]
+			reg := q.regs[j.TagID]
+			q.mu.Unlock()
+			row := o.(*fyne.Container).Objects
+			rows := row[0].(*fyne.Container).Objects
+			title := rows[0].(*widget.Label)
+			title.SetText(fmt.Sprintf("%s  (%s)", filepath.Base(j.Path), j.Kind))
+			title.TextStyle = fyne.TextStyle{Bold: true}
+			title.Refresh()
+			rows[1].(*widget.ProgressBar).SetValue(j.progress())
+			rows[2].(*widget.Label).SetText(q.detail(j, reg))
+			retry := row[1].(*widget.Button)
+			retry.OnTapped = func() { q.Retry(j.ID) }
+			if j.Stage == JobFailed || strings.HasPrefix(reg, RegFailed) {
+				retry.Enable()
+			} else {
+				retry.Disable()
+			}
+		},
+	)
+	if i.OnRegister == nil {
+		i.OnRegister = q.registered
+	} else {
+		prev := i.OnRegister
+		i.OnRegister = func(t Tag, err error) {
+			prev(t, err)
+			q.registered(t, err)
+		}
+	}
+	return q
+}
+
+// Widget returns the job list for embedding in the main window.
+func (q *JobQueue) Widget() fyne.CanvasObject {
+	return q.list
+}
+
+// Add queues a file for tagging.
+func (q *JobQueue) Add(path string) {
+	q.add(path, nil)
+}
+
+// AddAs queues a file whose tagged copy is saved according to policy.
+func (q *JobQueue) AddAs(path string, policy OutputConfig) {
+	q.add(path, &policy)
+}
+
+func (q *JobQueue) add(path string, policy *OutputConfig) {
+	q.mu.Lock()
+	j := &Job{ID: q.nextID, Path: path, Kind: documentKind(path), Stage: JobQueued, Policy: policy}
+	q.nextID++
+	q.jobs = append(q.jobs, j)
+	q.todo = append(q.todo, j)
+	q.prune()
+	q.mu.Unlock()
+	q.changed()
+	q.signal()
+}
+
+// prune drops the oldest finished jobs, and their registration states,
+// while the list is longer than maxJobs. Jobs still in progress are kept.
+// q.mu must be held.
+func (q *JobQueue) prune() {
+	excess := len(q.jobs) - maxJobs
+	if excess <= 0 {
+		return
+	}
+	kept := q.jobs[:0]
+	for _, j := range q.jobs {
+		if excess > 0 && (j.Stage == JobDone || j.Stage == JobFailed) {
+			excess--
+			delete(q.regs, j.TagID)
+			continue
+		}
+		kept = append(kept, j)
+	}
+	for k := len(kept); k < len(q.jobs); k++ {
+		q.jobs[k] = nil
+	}
+	q.jobs = kept
+	// tags registered outside the job list, e.g. distributed copies,
+	// have states too
+	if len(q.regs) > 2*maxJobs {
+		regs := make(map[string]string, len(q.jobs))
+		for _, j := range q.jobs {
+			if s, ok := q.regs[j.TagID]; ok {
+				regs[j.TagID] = s
+			}
+		}
+		q.regs = regs
+	}
+}
+
+// Retry runs a failed job again with a fresh tag, or asks the outbox to
+// retry a registration that hasn't gone through.
+func (q *JobQueue) Retry(id int) {
+	q.mu.Lock()
+	var j *Job
+	for _, job := range q.jobs {
+		if job.ID == id {
+			j = job
+		}
+	}
+	if j == nil {
+		q.mu.Unlock()
+		return
+	}
+	if j.Stage != JobFailed {
+		q.mu.Unlock()
+		if q.instance.Outbox != nil {
+			q.instance.Outbox.Wake()
+		}
+		return
+	}
+	*j = Job{ID: j.ID, Path: j.Path, Kind: j.Kind, Stage: JobQueued, Policy: j.Policy}
+	q.todo = append(q.todo, j)
+	q.mu.Unlock()
+	q.changed()
+	q.signal()
+}
+
+// Run starts the workers and returns once ctx is cancelled.
+func (q *JobQueue) Run(ctx context.Context) {
+	go q.refresh(ctx)
+	var wg sync.WaitGroup
+	for k := 0; k < q.workers; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *JobQueue) work(ctx context.Context) {
+	for {
+		j := q.next()
+		if j == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.wake:
+			}
+			continue
+		}
+		q.run(j)
+	}
+}
+
+// next takes the oldest waiting job, passing the wake on to another worker
+// when more are waiting.
+func (q *JobQueue) next() *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.todo) == 0 {
+		return nil
+	}
+	j := q.todo[0]
+	q.todo = q.todo[1:]
+	if len(q.todo) > 0 {
+		q.signal()
+	}
+	return j
+}
+
+func (q *JobQueue) run(j *Job) {
+	q.update(func() { j.Stage = JobTagging })
+	t, data, err := q.instance.TagFile(j.Path)
+	if err != nil {
+		q.instance.Logger.Printf("Error tagging %s: %v", j.Path, err)
+		q.update(func() { j.Stage, j.Err = JobFailed, err })
+		return
+	}
+	q.update(func() {
+		j.Stage, j.TagID = JobSaving, t.ID
+		if q.regs[t.ID] == "" {
+			q.regs[t.ID] = RegPending
+		}
+	})
+	policy := q.instance.Config.Output
+	if j.Policy != nil {
+		policy = *j.Policy
+	}
+	q.instance.saveTaggedAs(policy, j.Path, data, func(dest string, err error) {
+		if err == nil {
+			q.instance.recordOutput(t.ID, dest)
+		}
+		q.update(func() {
+			j.Stage, j.Output, j.Err = JobDone, dest, err
+			if err != nil {
+				j.Stage = JobFailed
+			}
+		})
+	})
+}
+
+// registered records the outcome of an attempt to register a tag.
+func (q *JobQueue) registered(t Tag, err error) {
+	q.mu.Lock()
+	switch {
+	case err == nil:
+		q.regs[t.ID] = RegRegistered
+	case errors.Is(err, ErrRejected):
+		q.regs[t.ID] = RegRejected
+	default:
+		q.regs[t.ID] = RegFailed + ": " + err.Error()
+	}
+	q.mu.Unlock()
+	q.changed()
+}
+
+func (q *JobQueue) detail(j Job, reg string) string {
+	if j.Stage == JobFailed {
+		return fmt.Sprintf("%s: %v", j.Stage, j.Err)
+	}
+	s := j.Stage
+	if j.TagID != "" {
+		s += fmt.Sprintf(" · tag %s, %s", j.TagID, reg)
+	}
+	if j.Output != "" {
+		s += " · " + j.Output
+	}
+	return s
+}
+
+func (q *JobQueue) update(f func()) {
+	q.mu.Lock()
+	f()
+	q.mu.Unlock()
+	q.changed()
+}
+
+// changed schedules a redraw of the list.
+func (q *JobQueue) changed() {
+	select {
+	case q.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// refresh redraws the list from one goroutine, so workers finishing
+// together don't refresh it concurrently, and folds bursts of changes into
+// one redraw.
+func (q *JobQueue) refresh(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.dirty:
+			q.list.Refresh()
+		}
+	}
+}
+
+func (q *JobQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// Label is one classification in the scheme users pick from.
+type Label struct {
+	Name  string `json:"name"`
+	Level Level  `json:"level"`
+	// Marking is the text of the visible header or footer, the upper-cased
+	// name when empty.
+	Marking string `json:"marking,omitempty"`
+}
+
+func (l Label) MarkingText() string {
+	if l.Marking != "" {
+		return l.Marking
+	}
+	return strings.ToUpper(l.Name)
+}
+
+// ClassificationConfig is the label scheme in config.json.
+type ClassificationConfig struct {
+	Labels []Label `json:"labels"`
+	// Property is the document property the label is written to.
+	Property string `json:"property"`
+	// Marking places the visible label: "header" or "footer".
+	Marking string `json:"marking"`
+	// Default is the lowest level an automatic label gets, so a document
+	// inspection finds nothing in isn't labelled public unless a user picks
+	// that. Internal when empty or unknown.
+	Default Level `json:"default,omitempty"`
+}
+
+func DefaultClassification() ClassificationConfig {
+	return ClassificationConfig{
+		Labels: []Label{
+			{Name: "Public", Level: LevelPublic},
+			{Name: "Internal", Level: LevelInternal},
+			{Name: "Confidential", Level: LevelConfidential},
+			{Name: "Restricted", Level: LevelRestricted},
+		},
+		Property: "Classification",
+		Marking:  "header",
+		Default:  LevelInternal,
+	}
+}
+
+// Resolve returns the label called name or, when name is empty, the label
+// for the level inspection derived, raised to c.Default: the first at that
+// level, else the highest below it.
+func (c ClassificationConfig) Resolve(name string, auto Level) (Label, bool) {
+	if name != "" {
+		for _, l := range c.Labels {
+			if strings.EqualFold(l.Name, name) {
+				return l, true
+			}
+		}
+		return Label{}, false
+	}
+	floor := c.Default
+	if _, ok := levelRank[floor]; !ok {
+		floor = LevelInternal
+	}
+	if levelRank[auto] < levelRank[floor] {
+		auto = floor
+	}
+	var best Label
+	found := false
+	for _, l := range c.Labels {
+		if l.Level == auto {
+			return l, true
+		}
+		if levelRank[l.Level] < levelRank[auto] && (!found || levelRank[l.Level] > levelRank[best.Level]) {
+			best, found = l, true
+		}
+	}
+	return best, found
+}
+
+// Names lists the labels in scheme order.
+func (c ClassificationConfig) Names() []string {
+	names := make([]string, len(c.Labels))
+	for k, l := range c.Labels {
+		names[k] = l.Name
+	}
+	return names
+}
+
+// applyLabel resolves the label for t from the user's choice and the
+// inspection result already on t, and records it.
+func (i *Instance) applyLabel(t *Tag) {
+	l, ok := i.Config.Classification.Resolve(i.Label, t.Classification)
+	if !ok {
+		if i.Label != "" {
+			i.Logger.Printf("Unknown classification label %q", i.Label)
+		}
+		return
+	}
+	if levelRank[l.Level] < levelRank[t.Classification] {
+		i.Logger.Printf("%s labelled %s although inspection found %s data", filepath.Base(t.FilePath), l.Name, t.Classification)
+	}
+	t.Label = l.Name
+	t.Classification = l.Level
+	if i.Marking {
+		t.Marking = l.MarkingText()
+	}
+}
+
+const (
+	nsCustomProps   = "http://schemas.openxmlformats.org/officeDocument/2006/custom-properties"
+	nsVTypes        = "http://schemas.openxmlformats.org/officeDocument/2006/docPropsVTypes"
+	relCustomProps  = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/custom-properties"
+	relHeader       = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/header"
+	relFooter       = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/footer"
+	typeCustomProps = "application/vnd.openxmlformats-officedocument.custom-properties+xml"
+	typeHeader      = "application/vnd.openxmlformats-officedocument.wordprocessingml.header+xml"
+	typeFooter      = "application/vnd.openxmlformats-officedocument.wordprocessingml.footer+xml"
+	// fmtid every user defined Office property is filed under
+	customPropsFmtID = "{D5CDD505-2E9C-101B-9397-08002B2CF9AE}"
+)
+
+// labelDocx writes t's label into docProps/custom.xml and, when t carries a
+// marking, into the header or footer of every section.
+func labelDocx(data []byte, cfg ClassificationConfig, t Tag) ([]byte, error) {
+	pkg, err := OpenPackage(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := setCustomProperty(pkg, cfg.Property, t.Label); err != nil {
+		return nil, fmt.Errorf("custom properties: %w", err)
+	}
+	if t.Marking != "" {
+		if err := addWordMarking(pkg, cfg.Marking, t.Marking); err != nil {
+			return nil, fmt.Errorf("marking: %w", err)
+		}
+	}
+	return pkg.Bytes()
+}
+
+// setCustomProperty sets a string custom document property, creating the
+// part and its registrations when the document has none.
+func setCustomProperty(pkg *Package, name, value string) error {
+	const part = "docProps/custom.xml"
+	var doc *etree.Document
+	var err error
+	if pkg.Has(part) {
+		doc, err = pkg.XML(part)
+	} else {
+		root := etree.NewElement("Properties")
+		root.CreateAttr("xmlns", nsCustomProps)
+		root.CreateAttr("xmlns:vt", nsVTypes)
+		doc, err = pkg.CreateXML(part, typeCustomProps, root)
+	}
+	if err != nil {
+		return err
+	}
+	root := doc.Root()
+	pid := 1
+	var prop *etree.Element
+	for _, e := range root.SelectElements("property") {
+		if n, err := strconv.Atoi(e.SelectAttrValue("pid", "")); err == nil && n > pid {
+			pid = n
+		}
+		if e.SelectAttrValue("name", "") == name {
+			prop = e
+		}
+	}
+	if prop == nil {
+		prop = root.CreateElement("property")
+		prop.CreateAttr("fmtid", customPropsFmtID)
+		prop.CreateAttr("pid", strconv.Itoa(pid+1))
+		prop.CreateAttr("name", name)
+	}
+	for _, c := range prop.ChildElements() {
+		prop.RemoveChild(c)
+	}
+	prop.CreateElement("vt:lpwstr").SetText(value)
+	if err := pkg.AddOverride(part, typeCustomProps); err != nil {
+		return err
+	}
+	_, err = pkg.AddRelationship("", relCustomProps, part, "")
+	return err
+}
+
+// addWordMarking puts text, centred and bold red, in the default header
+// (or footer) of every section.
+func addWordMarking(pkg *Package, where, text string) error {
+	kind := "header"
+	if where == "footer" {
+		kind = "footer"
+	}
+	return addToWordHeaders(pkg, kind, false, func(_ string, root *etree.Element, _ int) error {
+		root.AddChild(markingParagraph(text))
+		return nil
+	})
+}
+
+// headerFunc changes the root of the header or footer part name; n counts
+// the parts visited.
+type headerFunc func(name string, root *etree.Element, n int) error
+
+// addToWordHeaders calls add once for each default header (or footer) part
+// the sections use. A section without one inherits the previous section's,
+// so only a first section without one is given a new part; giving later
+// sections their own would drop the header they inherit. With all set,
+// first and even page parts the sections already have are included too.
+func addToWordHeaders(pkg *Package, kind string, all bool, add headerFunc) error {
+	relType, contentType := relHeader, typeHeader
+	if kind == "footer" {
+		relType, contentType = relFooter, typeFooter
+	}
+	main := pkg.MainDocument()
+	doc, err := pkg.XML(main)
+	if err != nil {
+		return err
+	}
+	body := doc.Root().SelectElement("w:body")
+	if body == nil {
+		return fmt.Errorf("no w:body in %s", main)
+	}
+	sections := doc.FindElements("//w:sectPr")
+	if len(sections) == 0 {
+		sections = append(sections, body.CreateElement("w:sectPr"))
+	}
+	refTag := "w:" + kind + "Reference"
+	var targets []string
+	seen := make(map[string]bool)
+	inherited := false
+	for _, s := range sections {
+		hasDefault := false
+		for _, r := range s.SelectElements(refTag) {
+			isDefault := r.SelectAttrValue("w:type", "default") == "default"
+			if !isDefault && !all {
+				continue
+			}
+			hasDefault = hasDefault || isDefault
+			target := pkg.RelationshipTarget(main, r.SelectAttrValue("r:id", ""))
+			if !seen[target] {
+				seen[target] = true
+				targets = append(targets, target)
+			}
+		}
+		if hasDefault || inherited {
+			inherited = true
+			continue
+		}
+		name := kind + "Dlp.xml"
+		root := etree.NewElement("w:" + map[string]string{"header": "hdr", "footer": "ftr"}[kind])
+		root.CreateAttr("xmlns:w", nsW)
+		root.CreateAttr("xmlns:r", nsR)
+		part := path.Join(path.Dir(main), name)
+		if _, err := pkg.CreateXML(part, contentType, root); err != nil {
+			return err
+		}
+		id, err := pkg.AddRelationship(main, relType, name, "")
+		if err != nil {
+			return err
+		}
+		targets = append(targets, part)
+		ref := etree.NewElement(refTag)
+		ref.CreateAttr("w:type", "default")
+		ref.CreateAttr("r:id", id)
+		// header and footer references lead the section properties
+		s.InsertChildAt(0, ref)
+		inherited = true
+	}
+	for n, target := range targets {
+		hdoc, err := pkg.XML(target)
+		if err != nil {
+			return fmt.Errorf("%s: %w", kind, err)
+		}
+		if err := add(target, hdoc.Root(), n); err != nil {
+			return err
+		}
+	}
+	if doc.Root().SelectAttr("xmlns:r") == nil {
+		doc.Root().CreateAttr("xmlns:r", nsR)
+	}
+	return nil
+}
+
+func markingParagraph(text string) *etree.Element {
+	p := etree.NewElement("w:p")
+	p.CreateElement("w:pPr").CreateElement("w:jc").CreateAttr("w:val", "center")
+	r := p.CreateElement("w:r")
+	rPr := r.CreateElement("w:rPr")
+	rPr.CreateElement("w:b")
+	rPr.CreateElement("w:color").CreateAttr("w:val", "C00000")
+	r.CreateElement("w:t").SetText(text)
+	return p
+}
+
+const (
+	nsOffice   = "urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+	nsMeta     = "urn:oasis:names:tc:opendocument:xmlns:meta:1.0"
+	nsManifest = "urn:oasis:names:tc:opendocument:xmlns:manifest:1.0"
+)
+
+// labelODF writes the label as a user defined property in an OpenDocument
+// file's meta.xml.
+func labelODF(data []byte, cfg ClassificationConfig, t Tag) ([]byte, error) {
+	parts, comment, err := readParts(data)
+	if err != nil {
+		return nil, err
+	}
+	var doc *etree.Document
+	if p := findPart(parts, "meta.xml"); p != nil {
+		if doc, err = parseXML(p.Data); err != nil {
+			return nil, err
+		}
+	} else {
+		doc = etree.NewDocument()
+		root := doc.CreateElement("office:document-meta")
+		root.CreateAttr("xmlns:office", nsOffice)
+		root.CreateAttr("xmlns:meta", nsMeta)
+		root.CreateAttr("office:version", "1.2")
+		if parts, err = addManifestEntry(parts, "meta.xml", "text/xml"); err != nil {
+			return nil, err
+		}
+	}
+	meta := doc.Root().SelectElement("office:meta")
+	if meta == nil {
+		meta = doc.Root().CreateElement("office:meta")
+	}
+	var prop *etree.Element
+	for _, e := range meta.SelectElements("meta:user-defined") {
+		if e.SelectAttrValue("meta:name", "") == cfg.Property {
+			prop = e
+		}
+	}
+	if prop == nil {
+		prop = meta.CreateElement("meta:user-defined")
+		prop.CreateAttr("meta:name", cfg.Property)
+	}
+	prop.SetText(t.Label)
+	out, err := xmlBytes(doc)
+	if err != nil {
+		return nil, err
+	}
+	return writeParts(addPart(parts, "meta.xml", out), comment)
+}
+
+func addManifestEntry(parts []*zipPart, name, mediaType string) ([]*zipPart, error) {
+	p := findPart(parts, "META-INF/manifest.xml")
+	if p == nil {
+		return nil, fmt.Errorf("META-INF/manifest.xml not found")
+	}
+	doc, err := parseXML(p.Data)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range doc.Root().SelectElements("manifest:file-entry") {
+		if e.SelectAttrValue("manifest:full-path", "") == name {
+			return parts, nil
+		}
+	}
+	e := doc.Root().CreateElement("manifest:file-entry")
+	e.CreateAttr("manifest:full-path", name)
+	e.CreateAttr("manifest:media-type", mediaType)
+	if p.Data, err = xmlBytes(doc); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
@@ -0,0 +1,35 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// lockFile takes an exclusive lock on path by creating it, and blocks until
+// it's free. A lock left behind by a process that died is broken after
+// staleLock.
+func lockFile(path string) (unlock func(), err error) {
+	const staleLock = 30 * time.Second
+	deadline := time.Now().Add(2 * staleLock)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("timed out waiting for " + path)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	_ "embed"
 	"fmt"
 	"image/color"
 	"log"
 	"os"
+	"path/filepath"
 	"time"
 
 	"fyne.io/fyne/v2"
@@ -12,17 +15,28 @@ import (
 	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 )
 
+// bgJPG is built in so the window doesn't depend on the working directory,
+// which is $HOME when started at login.
+//
+//go:embed data/bg.jpg
+var bgJPG []byte
+
 func main() {
 	api := API{
 		URL:      "http://fairlady:8081",
 		Username: "admin",
 		Password: "password",
 	}
-	f, err := os.OpenFile("instance.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logPath, err := DefaultLogPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -30,37 +44,196 @@ func main() {
 	logger := log.New(f, "instance: ", log.LstdFlags)
 	storage := HttpStorage{
 		Endpoint: api.URL,
+		Username: api.Username,
+		Password: api.Password,
 	}
 	messageLabel := widget.NewLabel("")
 	instance := NewInstance(api, logger, "localhost:4242", messageLabel)
 	instance.Storage = &storage
+	configPath, err := DefaultConfigPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// a config that failed to load is left for the user to fix, not
+	// overwritten with the defaults
+	saveConfig := true
+	if instance.Config, err = LoadConfig(configPath); err != nil {
+		instance.Logger.Println("Error loading config, using defaults:", err)
+		saveConfig = false
+	}
+	if instance.Analyzer, err = NewHitAnalyzer(instance, instance.Config); err != nil {
+		log.Fatal(err)
+	}
+	if instance.Inspector, err = NewInspector(instance.Config.Inspection); err != nil {
+		log.Fatal(err)
+	}
+	keyPath, err := DefaultDeviceKeyPath()
+	if err == nil {
+		instance.DeviceKey, err = LoadOrCreateDeviceKey(keyPath)
+	}
+	if err != nil {
+		instance.Logger.Println("Error loading device key, tags will be unsigned:", err)
+	}
+	tagDBPath, err := DefaultTagDBPath()
+	if err == nil {
+		instance.TagDB, err = OpenTagDB(tagDBPath)
+	}
+	if err != nil {
+		instance.Logger.Println("Error opening tag database, tags won't be listed:", err)
+	}
+	// registering a signed tag enrolls first, from the CLI too
+	if instance.TLS, err = DefaultTLSFiles(); err != nil {
+		log.Fatal(err)
+	}
+	// tags are queued before any tagged copy is written, from the CLI too
+	outboxPath, err := DefaultOutboxPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if instance.Outbox, err = OpenOutbox(outboxPath, instance.SendTag, instance.Logger); err != nil {
+		instance.Logger.Println("Error opening outbox, tags will be sent directly:", err)
+	}
+	// as an agent the window starts hidden and closing it leaves the tray
+	// icon running
+	agentMode := len(os.Args) > 1 && os.Args[1] == "agent"
+	if len(os.Args) > 1 && !agentMode {
+		code := runCLI(instance, os.Args[1:])
+		if instance.Outbox != nil {
+			// one delivery attempt; whatever is left goes out with the
+			// next GUI session
+			instance.Outbox.Flush(context.Background())
+		}
+		os.Exit(code)
+	}
 	instance.Logger.Println("Starting application...")
 	a := app.NewWithID("com.example.dlpeagle")
 	w := a.NewWindow("DLPeagle")
 	instance.Window = w
 
-	toolbar := widget.NewToolbar(
-		widget.NewToolbarAction(theme.DocumentIcon(), func() {
-			fmt.Println("testing server connection")
-			if !instance.IsConnected() {
-				dialog.ShowInformation("Connection", "Not connected to the server.", w)
+	status := widget.NewLabel(StateOffline.String())
+	pending := widget.NewLabel("")
+	if outbox := instance.Outbox; outbox != nil {
+		outbox.OnChange = func(n, rejected int) {
+			switch {
+			case rejected > 0:
+				pending.SetText(fmt.Sprintf("%d pending, %d rejected", n, rejected))
+			case n > 0:
+				pending.SetText(fmt.Sprintf("%d pending", n))
+			default:
+				pending.SetText("")
+			}
+		}
+		outbox.OnChange(outbox.Pending(), outbox.Rejected())
+	}
+	instance.QUIC.OnStateChange = func(s ConnState) {
+		status.SetText(s.String())
+		if s == StateLive && instance.Outbox != nil {
+			// the server is reachable again, don't wait out the backoff
+			instance.Outbox.Wake()
+		}
+	}
+	historyPath, err := DefaultHistoryPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := instance.LoadHistory(historyPath); err != nil {
+		instance.Logger.Println("Error loading notification history:", err)
+	}
+	inbox := NewInbox(instance, a)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// redeliveries are dropped before anything is looked up for them, and
+	// hits are analysed one at a time, in order, off the QUIC reader. A hit
+	// is acked once it's in the history, so one still queued here when we
+	// exit is redelivered by the server.
+	type hit struct {
+		n   Notification
+		ack func()
+	}
+	hits := make(chan hit, 256)
+	instance.QUIC.OnNotification = func(n Notification, ack func()) {
+		if instance.SeenNotification(n.ID) {
+			ack()
+			return
+		}
+		select {
+		case hits <- hit{n, ack}:
+		case <-ctx.Done():
+		}
+	}
+	go func() {
+		for {
+			var h hit
+			select {
+			case <-ctx.Done():
+				return
+			case h = <-hits:
+			}
+			n := h.n
+			report := instance.Analyzer.Analyze(ctx, n)
+			n.Severity = report.Grade()
+			n.Info = report.Summary()
+			isNew, err := instance.AddNotification(n)
+			if err == nil {
+				h.ack()
+			}
+			if !isNew {
+				continue
+			}
+			if instance.Paused() {
+				inbox.Add(n)
+				continue
+			}
+			inbox.Notify(n)
+			go instance.Alert(n)
+		}
+	}()
+	// without a client certificate the server won't hand us alerts, so
+	// enrollment is retried along with the connection
+	instance.QUIC.Prepare = instance.SetupTLS
+	go instance.QUIC.Run(ctx)
+	if instance.Outbox != nil {
+		go instance.Outbox.Run(ctx)
+	}
+	jobs := NewJobQueue(instance, DefaultJobWorkers)
+	go jobs.Run(ctx)
+	watcher, err := NewWatcher(instance, jobs, instance.Config.Watch)
+	if err != nil {
+		instance.Logger.Println("Error starting folder watcher, folders won't be watched:", err)
+	} else {
+		watcher.OnConfigChange = func(cfg WatchConfig) {
+			instance.Config.Watch = cfg
+			if !saveConfig {
+				instance.Logger.Println("Not saving watch folders over", configPath, "until it loads")
 				return
 			}
-			dialog.ShowInformation("Connection", "Connected to the server.", w)
+			if err := SaveConfig(configPath, instance.Config); err != nil {
+				instance.Logger.Println("Error saving config:", err)
+			}
+		}
+		go watcher.Run(ctx)
+	}
+
+	toolbar := widget.NewToolbar(
+		widget.NewToolbarAction(theme.DocumentIcon(), func() {
+			// the ping can take the client's whole timeout
+			go func() {
+				if !instance.IsConnected() {
+					dialog.ShowInformation("Connection", "Not connected to the server.", w)
+					return
+				}
+				dialog.ShowInformation("Connection", "Connected to the server.", w)
+			}()
 		}),
 		widget.NewToolbarSeparator(),
 		widget.NewToolbarAction(theme.SettingsIcon(), func() {
 			fmt.Println("Settings clicked")
 		}),
 	)
-	resource, err := fyne.LoadResourceFromPath("data/bg.jpg")
-	if err != nil {
-		dialog.ShowError(err, w)
-		return
-	}
-	bgImage := canvas.NewImageFromResource(resource)
+	bgImage := canvas.NewImageFromResource(fyne.NewStaticResource("bg.jpg", bgJPG))
 	bgImage.FillMode = canvas.ImageFillStretch
-	content := widget.NewLabel("Drag and drop a document here.")
+	content := widget.NewLabel("Drag and drop documents here.")
+	content.Alignment = fyne.TextAlignCenter
 
 	// Create a warning rectangle (initially hidden)
 	warningRect := canvas.NewRectangle(color.RGBA{255, 0, 0, 128}) // Semi-transparent red
@@ -68,11 +241,81 @@ func main() {
 
 	stackedContent := container.NewStack(
 		bgImage,
-		container.NewCenter(content),
+		container.NewBorder(content, nil, nil, nil, jobs.Widget()),
 		warningRect, // Add the warning rectangle
 	)
 
-	w.SetContent(container.NewBorder(toolbar, nil, nil, nil, stackedContent))
+	// dropped files are tagged, checked for an existing tag or tagged once
+	// per recipient
+	dropMode := widget.NewRadioGroup([]string{"Tag", "Verify", "Distribute"}, func(mode string) {
+		switch mode {
+		case "Verify":
+			content.SetText("Drop a document to check its tag.")
+		case "Distribute":
+			content.SetText("Drop a document to tag a copy for each recipient.")
+		default:
+			content.SetText("Drag and drop documents here.")
+		}
+	})
+	dropMode.Horizontal = true
+	dropMode.Required = true
+	dropMode.SetSelected("Tag")
+
+	// classification applied when tagging; automatic uses the inspection
+	const autoLabel = "Automatic"
+	labelSelect := widget.NewSelect(append([]string{autoLabel}, instance.Config.Classification.Names()...), func(l string) {
+		instance.Label = ""
+		if l != autoLabel {
+			instance.Label = l
+		}
+	})
+	labelSelect.SetSelected(autoLabel)
+	markingCheck := widget.NewCheck("Visible marking", func(on bool) {
+		instance.Marking = on
+	})
+	watermarkCheck := widget.NewCheck("Watermark", func(on bool) {
+		instance.Watermark = on
+	})
+	tagOptions := container.NewHBox(dropMode, layout.NewSpacer(), labelSelect, markingCheck, watermarkCheck)
+
+	inboxTab := container.NewTabItem("Inbox", inbox.Widget())
+	myTags := NewMyTags(instance, a)
+	myTagsTab := container.NewTabItem("My tags", myTags.Widget())
+	tabs := container.NewAppTabs(
+		container.NewTabItem("Tag", container.NewBorder(nil, tagOptions, nil, nil, stackedContent)),
+		inboxTab,
+		myTagsTab,
+	)
+	if watcher != nil {
+		tabs.Append(container.NewTabItem("Watched", NewWatchView(watcher, w).Widget()))
+	}
+	tabs.OnSelected = func(t *container.TabItem) {
+		if t == myTagsTab {
+			myTags.Refresh()
+		}
+	}
+	inbox.OnUnreadChange = func(n int) {
+		inboxTab.Text = "Inbox"
+		if n > 0 {
+			inboxTab.Text = fmt.Sprintf("Inbox (%d)", n)
+		}
+		tabs.Refresh()
+	}
+	inbox.OnOpen = func() {
+		tabs.Select(inboxTab)
+		w.Show()
+		w.RequestFocus()
+	}
+	agent := NewAgent(instance, a, inbox, jobs)
+	agent.OnShow = func() {
+		w.Show()
+		w.RequestFocus()
+	}
+	hasTray := agent.SetupTray()
+	inbox.OnUnreadChange(inbox.Unread())
+
+	top := container.NewBorder(nil, nil, nil, container.NewHBox(pending, status), toolbar)
+	w.SetContent(container.NewBorder(top, nil, nil, nil, tabs))
 
 	// w.Resize(fyne.NewSize(600, 400))
 	w.Resize(fyne.NewSize(600, 400))
@@ -81,7 +324,10 @@ func main() {
 		if len(uris) == 0 {
 			return
 		}
-		if !instance.IsConnected() {
+		// the notification channel's state is what we last saw of the
+		// server; pinging it here would block the window. Tagging goes
+		// ahead either way, registrations wait in the outbox.
+		if instance.QUIC.State() != StateLive {
 			// Display warning
 			warningRect.Show()
 			warningRect.Resize(fyne.NewSize(w.Canvas().Size().Width, 20)) // Adjust size as needed
@@ -96,6 +342,18 @@ func main() {
 			warningRect.Hide()
 		}
 
+		if dropMode.Selected == "Tag" {
+			// every dropped file becomes a job; folders are skipped
+			for _, u := range uris {
+				if info, err := os.Stat(u.Path()); err != nil {
+					dialog.ShowError(err, w)
+				} else if !info.IsDir() {
+					jobs.Add(u.Path())
+				}
+			}
+			return
+		}
+
 		filePath := uris[0].Path()
 		fileInfo, err := os.Stat(filePath)
 		if err != nil {
@@ -108,24 +366,26 @@ func main() {
 			return
 		}
 
-		documentType := instance.inferDocumentType(filePath)
-		metadata := generateMetadata(filePath, documentType)
-
-		// Display results (replace with your metadata handling logic)
-		resultText := fmt.Sprintf("File: %s\nType: %s\nMetadata: %v", filePath, documentType, metadata)
-		content.SetText(resultText)
+		if dropMode.Selected == "Verify" {
+			content.SetText("Verifying " + filepath.Base(filePath) + "...")
+			go func() {
+				v, err := instance.VerifyFile(ctx, filePath)
+				if err != nil {
+					dialog.ShowError(err, w)
+					return
+				}
+				content.SetText(v.String())
+			}()
+			return
+		}
 
+		instance.showDistribute(filePath, content)
 	})
 
-	// Initial API connection check
-	if !instance.IsConnected() {
-		warningRect.Show()
-		warningRect.Resize(fyne.NewSize(w.Canvas().Size().Width, 20))
-		warningRect.Move(fyne.NewPos(0, 0))
-		time.AfterFunc(5*time.Second, func() {
-			warningRect.Hide()
-		})
+	if agentMode && hasTray {
+		w.SetCloseIntercept(w.Hide)
+		a.Run()
+		return
 	}
-
 	w.ShowAndRun()
 }
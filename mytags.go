@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/storage"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// MyTags lists the tags created on this machine together with the ones the
+// server holds for this user, and how often each beacon has fired.
+type MyTags struct {
+	instance *Instance
+	app      fyne.App
+	list     *widget.List
+	search   *widget.Entry
+	status   *widget.Label
+	mu       sync.Mutex
+	all      []TagRecord
+	shown    []TagRecord
+	hits     map[string]int
+	gen      int // bumped by every Refresh, so a slow count can tell it is stale
+}
+
+// hitWorkers is how many tags' hits are fetched from the server at once.
+const hitWorkers = 4
+
+func NewMyTags(i *Instance, a fyne.App) *MyTags {
+	m := &MyTags{
+		instance: i,
+		app:      a,
+		status:   widget.NewLabel(""),
+		hits:     make(map[string]int),
+	}
+	m.search = widget.NewEntry()
+	m.search.SetPlaceHolder("Search by file name, hash, tag or date (2006-01-02)")
+	m.search.OnChanged = func(string) { m.filter() }
+	m.list = widget.NewList(
+		func() int {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return len(m.shown)
+		},
+		func() fyne.CanvasObject {
+			actions := container.NewHBox(
+				widget.NewButtonWithIcon("", theme.FolderOpenIcon(), nil),
+				widget.NewButtonWithIcon("", theme.ContentCopyIcon(), nil),
+				widget.NewButtonWithIcon("", theme.DeleteIcon(), nil),
+			)
+			return container.NewBorder(nil, nil, nil, actions,
+				container.NewVBox(widget.NewLabel(""), widget.NewLabel("")))
+		},
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			m.mu.Lock()
+			if id >= len(m.shown) {
+				m.mu.Unlock()
+				return
+			}
+			r := m.shown[id]
+			hits := m.hits[r.ID]
+			m.mu.Unlock()
+			row := o.(*fyne.Container).Objects
+			lines := row[0].(*fyne.Container).Objects
+			title := lines[0].(*widget.Label)
+			name := filepath.Base(r.FilePath)
+			if r.Revoked {
+				name += " (revoked)"
+			}
+			title.SetText(name)
+			title.TextStyle = fyne.TextStyle{Bold: true}
+			title.Refresh()
+			lines[1].(*widget.Label).SetText(tagSummary(r, hits))
+			buttons := row[1].(*fyne.Container).Objects
+			buttons[0].(*widget.Button).OnTapped = func() { m.openFolder(r) }
+			buttons[1].(*widget.Button).OnTapped = func() { m.copyID(r) }
+			revoke := buttons[2].(*widget.Button)
+			revoke.OnTapped = func() { m.revoke(r) }
+			if r.Revoked {
+				revoke.Disable()
+			} else {
+				revoke.Enable()
+			}
+		},
+	)
+	return m
+}
+
+// Widget returns the tag list for embedding in the main window.
+func (m *MyTags) Widget() fyne.CanvasObject {
+	refresh := widget.NewButtonWithIcon("", theme.ViewRefreshIcon(), m.Refresh)
+	export := widget.NewButtonWithIcon("Export", theme.DocumentSaveIcon(), m.export)
+	top := container.NewBorder(nil, nil, nil, container.NewHBox(refresh, export), m.search)
+	return container.NewBorder(top, m.status, nil, nil, m.list)
+}
+
+// Refresh shows the local tags straight away, with the hits this client
+// has received, and adds the server's list and its hit counts once they
+// arrive.
+func (m *MyTags) Refresh() {
+	var local []TagRecord
+	if m.instance.TagDB != nil {
+		local = m.instance.TagDB.All()
+	}
+	m.mu.Lock()
+	m.gen++
+	gen := m.gen
+	m.mu.Unlock()
+	m.set(local)
+	go func() {
+		username, err := GetUsername()
+		if err != nil {
+			m.instance.Logger.Println("Error getting username:", err)
+			return
+		}
+		remote, err := m.instance.Client.ListTags(context.Background(), username)
+		if err != nil {
+			m.instance.Logger.Println("Error listing tags:", err)
+			m.status.SetText(fmt.Sprintf("%d tags on this machine; server unavailable", len(local)))
+			return
+		}
+		all := mergeTags(local, remote)
+		m.set(all)
+		m.countHits(gen, all)
+	}()
+}
+
+// set shows all, counting the hits this client has received for each. A
+// count already fetched from the server is kept if it is higher.
+func (m *MyTags) set(all []TagRecord) {
+	hits := make(map[string]int)
+	if m.instance.Analyzer != nil {
+		for id, t := range m.instance.Analyzer.Timelines() {
+			hits[id] = len(t)
+		}
+	}
+	m.mu.Lock()
+	for id, n := range m.hits {
+		if n > hits[id] {
+			hits[id] = n
+		}
+	}
+	m.all, m.hits = all, hits
+	m.mu.Unlock()
+	m.filter()
+}
+
+// countHits replaces the local hit counts with the server's, which include
+// hits delivered while this client was offline or to another install.
+func (m *MyTags) countHits(gen int, all []TagRecord) {
+	ids := make(chan string)
+	var wg sync.WaitGroup
+	for k := 0; k < hitWorkers; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+				hits, err := m.instance.Client.Hits(ctx, id)
+				cancel()
+				if err != nil {
+					m.instance.Logger.Printf("Error getting hits of %s: %v", id, err)
+					continue
+				}
+				m.mu.Lock()
+				if m.gen == gen {
+					m.hits[id] = len(hits)
+				}
+				m.mu.Unlock()
+			}
+		}()
+	}
+	for _, r := range all {
+		m.mu.Lock()
+		stale := m.gen != gen
+		m.mu.Unlock()
+		if stale {
+			break
+		}
+		ids <- r.ID
+	}
+	close(ids)
+	wg.Wait()
+	m.list.Refresh()
+}
+
+// filter re-applies the search to the loaded tags.
+func (m *MyTags) filter() {
+	q := strings.ToLower(strings.TrimSpace(m.search.Text))
+	m.mu.Lock()
+	shown := make([]TagRecord, 0, len(m.all))
+	for _, r := range m.all {
+		if q == "" || matchTag(r, q) {
+			shown = append(shown, r)
+		}
+	}
+	m.shown = shown
+	total := len(m.all)
+	m.mu.Unlock()
+	m.status.SetText(fmt.Sprintf("%d of %d tags", len(shown), total))
+	m.list.Refresh()
+}
+
+// matchTag reports whether the lower-case query q appears in r's file
+// names, hashes, ID or creation date.
+func matchTag(r TagRecord, q string) bool {
+	for _, s := range []string{
+		baseName(r.FilePath), baseName(r.Output), r.ID,
+		r.OriginalHash, r.TaggedHash, tagTime(r.Tag).Format("2006-01-02 15:04"),
+	} {
+		if s != "" && strings.Contains(strings.ToLower(s), q) {
+			return true
+		}
+	}
+	return false
+}
+
+// baseName is filepath.Base without its "." for an empty path, which would
+// match every search for a dot.
+func baseName(path string) string {
+	if path == "" {
+		return ""
+	}
+	return filepath.Base(path)
+}
+
+func tagTime(t Tag) time.Time {
+	return time.Unix(int64(t.Created), 0)
+}
+
+func tagSummary(r TagRecord, hits int) string {
+	parts := []string{tagTime(r.Tag).Format("2006-01-02 15:04")}
+	switch hits {
+	case 0:
+		parts = append(parts, "not opened")
+	case 1:
+		parts = append(parts, "opened once")
+	default:
+		parts = append(parts, fmt.Sprintf("opened %d times", hits))
+	}
+	if r.Label != "" {
+		parts = append(parts, r.Label)
+	}
+	if r.Recipient != "" {
+		parts = append(parts, "sent to "+r.Recipient)
+	}
+	return strings.Join(append(parts, r.ID), "  ·  ")
+}
+
+// mergeTags adds the server's tags to the local ones. Tags created on
+// other machines only have what the server knows about them.
+func mergeTags(local []TagRecord, remote []Tag) []TagRecord {
+	out := append([]TagRecord(nil), local...)
+	index := make(map[string]int, len(out))
+	for k, r := range out {
+		index[r.ID] = k
+	}
+	for _, t := range remote {
+		if k, ok := index[t.ID]; ok {
+			out[k].Revoked = out[k].Revoked || t.Revoked
+			continue
+		}
+		out = append(out, TagRecord{Tag: t})
+	}
+	sort.SliceStable(out, func(a, b int) bool { return out[a].Created > out[b].Created })
+	return out
+}
+
+// openFolder shows the folder holding the tagged copy, or the original
+// when we don't know where the copy went.
+func (m *MyTags) openFolder(r TagRecord) {
+	path := r.Output
+	if path == "" {
+		path = r.FilePath
+	}
+	dir := filepath.Dir(path)
+	if _, err := os.Stat(dir); err != nil {
+		dialog.ShowError(err, m.instance.Window)
+		return
+	}
+	u, err := url.Parse(storage.NewFileURI(dir).String())
+	if err != nil {
+		dialog.ShowError(err, m.instance.Window)
+		return
+	}
+	if err := m.app.OpenURL(u); err != nil {
+		dialog.ShowError(err, m.instance.Window)
+	}
+}
+
+func (m *MyTags) copyID(r TagRecord) {
+	m.instance.Window.Clipboard().SetContent(r.ID)
+	m.status.SetText("Copied " + r.ID)
+}
+
+// revoke asks the server to stop reporting opens of r's copies.
+func (m *MyTags) revoke(r TagRecord) {
+	msg := fmt.Sprintf("Stop reporting when %s is opened?\nThis can't be undone.", filepath.Base(r.FilePath))
+	dialog.ShowConfirm("Revoke tag", msg, func(ok bool) {
+		if !ok {
+			return
+		}
+		go func() {
+			var sig string
+			if m.instance.DeviceKey != nil {
+				sig = SignRevocation(r.ID, m.instance.DeviceKey)
+			}
+			if err := m.instance.Client.RevokeTag(context.Background(), r.ID, sig); err != nil {
+				dialog.ShowError(err, m.instance.Window)
+				return
+			}
+			if m.instance.TagDB != nil {
+				if err := m.instance.TagDB.Revoke(r.ID); err != nil {
+					m.instance.Logger.Println("Error saving tag:", err)
+				}
+			}
+			m.mu.Lock()
+			for k := range m.all {
+				if m.all[k].ID == r.ID {
+					m.all[k].Revoked = true
+				}
+			}
+			m.mu.Unlock()
+			m.filter()
+		}()
+	}, m.instance.Window)
+}
+
+// export saves the tags currently shown as CSV.
+func (m *MyTags) export() {
+	m.mu.Lock()
+	rows := append([]TagRecord(nil), m.shown...)
+	hits := m.hits
+	m.mu.Unlock()
+	d := dialog.NewFileSave(func(w fyne.URIWriteCloser, err error) {
+		if err != nil || w == nil {
+			return
+		}
+		defer w.Close()
+		if err := writeTagsCSV(w, rows, hits); err != nil {
+			dialog.ShowError(err, m.instance.Window)
+			return
+		}
+		m.status.SetText(fmt.Sprintf("Exported %d tags to %s", len(rows), w.URI().Path()))
+	}, m.instance.Window)
+	d.SetFileName("tags.csv")
+	d.Show()
+}
+
+func writeTagsCSV(out io.Writer, rows []TagRecord, hits map[string]int) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"id", "created", "file", "output", "original_hash", "tagged_hash",
+		"label", "recipient", "hits", "revoked"})
+	for _, r := range rows {
+		w.Write([]string{r.ID, tagTime(r.Tag).Format(time.RFC3339), r.FilePath, r.Output,
+			r.OriginalHash, r.TaggedHash, r.Label, r.Recipient,
+			strconv.Itoa(hits[r.ID]), strconv.FormatBool(r.Revoked)})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -1,22 +1,51 @@
 package main
 
 import (
-	"fmt"
-	"os"
+	"bytes"
+	"log"
+	"math"
 	"time"
 )
 
 type Notification struct {
-	ID   string `json:"id"`
-	Info string `json:"info"`
-	Time string `json:"time"`
+	ID        string   `json:"id"`
+	Info      string   `json:"info"`
+	Time      string   `json:"time"`
+	TagID     string   `json:"tag_id"`     // Tag whose beacon fired.
+	IP        string   `json:"ip"`         // Address the beacon was fetched from.
+	UserAgent string   `json:"user_agent"` // User agent of the fetching client.
+	Severity  Severity `json:"severity"`
 }
 
+// Severity ranks how urgent an alert is; it selects the alert pattern.
+type Severity string
+
+const (
+	SeverityLow      Severity = "low"
+	SeverityMedium   Severity = "medium"
+	SeverityHigh     Severity = "high"
+	SeverityCritical Severity = "critical"
+)
+
+type Waveform int
+
+const (
+	WaveSine Waveform = iota
+	WaveSquare
+)
+
+// DefaultSampleRate is CD quality, which every audio backend accepts.
+const DefaultSampleRate = 44100
+
+// SoundBlock is a single tone. Period is the silence that follows it when
+// it is played as part of a pattern.
 type SoundBlock struct {
 	Duration   time.Duration `json:"duration"`
 	Frequency  float64       `json:"frequency"`
 	SampleRate int           `json:"sample_rate"`
 	Period     time.Duration `json:"period"`
+	Waveform   Waveform      `json:"waveform"`
+	Volume     float64       `json:"volume"` // 0..1
 }
 
 func NewSoundBlock(duration, period time.Duration, frequency float64, sampleRate int) *SoundBlock {
@@ -25,27 +54,113 @@ func NewSoundBlock(duration, period time.Duration, frequency float64, sampleRate
 		Frequency:  frequency,
 		SampleRate: sampleRate,
 		Period:     period,
+		Volume:     0.5,
 	}
 }
 
 func SoundBlockIn440Hz(t time.Duration) *SoundBlock {
-	samples := int(float64(440) * t.Seconds())
-	fmt.Println(samples, t)
-	period := time.Second / time.Duration(samples)
-	return NewSoundBlock(t, period, 440, samples)
+	return NewSoundBlock(t, t/2, 440, DefaultSampleRate)
 }
 
 func SoundBlockIn880Hz(t time.Duration) *SoundBlock {
-	samples := int(float64(880) * t.Seconds())
-	period := time.Second / time.Duration(samples)
-	return NewSoundBlock(t, period, 880, samples)
+	return NewSoundBlock(t, t/2, 880, DefaultSampleRate)
 }
 
+// Samples synthesises the tone as signed 16-bit mono PCM followed by Period
+// worth of silence. The first and last few milliseconds are ramped so the
+// speaker doesn't click.
+func (s *SoundBlock) Samples() []int16 {
+	rate := s.SampleRate
+	if rate <= 0 {
+		rate = DefaultSampleRate
+	}
+	n := int(s.Duration.Seconds() * float64(rate))
+	gap := int(s.Period.Seconds() * float64(rate))
+	out := make([]int16, n+gap)
+	ramp := rate / 200 // 5ms
+	if ramp > n/2 {
+		ramp = n / 2
+	}
+	amp := s.Volume
+	if amp <= 0 || amp > 1 {
+		amp = 0.5
+	}
+	for k := 0; k < n; k++ {
+		phase := 2 * math.Pi * s.Frequency * float64(k) / float64(rate)
+		v := math.Sin(phase)
+		if s.Waveform == WaveSquare {
+			if v >= 0 {
+				v = 1
+			} else {
+				v = -1
+			}
+		}
+		env := 1.0
+		if k < ramp {
+			env = float64(k) / float64(ramp)
+		} else if k >= n-ramp {
+			env = float64(n-k) / float64(ramp)
+		}
+		out[k] = int16(v * env * amp * math.MaxInt16)
+	}
+	return out
+}
+
+// WAV renders the block as a complete WAV file.
+func (s *SoundBlock) WAV() []byte {
+	var buf bytes.Buffer
+	EncodeWAV(&buf, s.Samples(), s.SampleRate)
+	return buf.Bytes()
+}
+
+// PlaySound plays the tone on the default audio output.
 func (s *SoundBlock) PlaySound() {
-	for i := 0; i < s.SampleRate; i++ {
-		if i%2 == 0 {
-			os.Stdout.Write([]byte{7}) // ASCII bell character
+	if err := DefaultAudioOutput().Play(s.WAV()); err != nil {
+		log.Println("Error playing sound:", err)
+	}
+}
+
+// AlertPattern derives the tone sequence for a severity from a base tone:
+// more urgent alerts repeat faster and climb in pitch.
+func AlertPattern(base SoundBlock, sev Severity) []SoundBlock {
+	tone := func(mult float64, d time.Duration, w Waveform) SoundBlock {
+		b := base
+		b.Frequency = base.Frequency * mult
+		b.Duration = d
+		b.Period = d / 2
+		b.Waveform = w
+		return b
+	}
+	short := 150 * time.Millisecond
+	switch sev {
+	case SeverityCritical:
+		return []SoundBlock{
+			tone(1, short, WaveSquare), tone(1.5, short, WaveSquare),
+			tone(1, short, WaveSquare), tone(1.5, short, WaveSquare),
+			tone(2, 2*short, WaveSquare),
+		}
+	case SeverityHigh:
+		return []SoundBlock{tone(1, short, WaveSine), tone(1.5, short, WaveSine), tone(2, short, WaveSine)}
+	case SeverityMedium:
+		return []SoundBlock{tone(1, short, WaveSine), tone(1, short, WaveSine)}
+	default:
+		return []SoundBlock{tone(1, 2*short, WaveSine)}
+	}
+}
+
+// PatternWAV joins a pattern into a single WAV so it plays without gaps
+// between process launches.
+func PatternWAV(blocks []SoundBlock) []byte {
+	var samples []int16
+	rate := DefaultSampleRate
+	for _, b := range blocks {
+		if b.SampleRate > 0 {
+			rate = b.SampleRate
 		}
-		time.Sleep(s.Period)
+		b.SampleRate = rate
+		samples = append(samples, b.Samples()...)
 	}
+	var buf bytes.Buffer
+	EncodeWAV(&buf, samples, rate)
+	return buf.Bytes()
 }
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// zipPart is one file in an Office or ODF package. Parts read from an
+// archive remember their entry so an unchanged part can be copied back
+// byte for byte.
+type zipPart struct {
+	Header zip.FileHeader
+	Data   []byte
+
+	file *zip.File
+	orig []byte
+}
+
+// changed reports whether the part has to be recompressed.
+func (p *zipPart) changed() bool {
+	return p.file == nil || !bytes.Equal(p.Data, p.orig)
+}
+
+// readParts loads every file of a zip package, in order, and the archive
+// comment.
+func readParts(data []byte) ([]*zipPart, string, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, "", err
+	}
+	parts := make([]*zipPart, 0, len(r.File))
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			return nil, "", err
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		parts = append(parts, &zipPart{Header: f.FileHeader, Data: b, file: f, orig: b})
+	}
+	return parts, r.Comment, nil
+}
+
+// writeParts writes parts back out in order. Unchanged entries are copied
+// raw, so their compressed bytes, times, comments and extra fields stay as
+// they were; changed ones are recompressed under a copy of their original
+// header. Only the changed and added entries differ from the input.
+func writeParts(parts []*zipPart, comment string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	for _, p := range parts {
+		if !p.changed() {
+			if err := w.Copy(p.file); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		fw, err := w.CreateHeader(rewriteHeader(p.Header))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write(p.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.SetComment(comment); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// rewriteHeader prepares a copy of h for an entry with new contents: the
+// sizes and checksum are left to the writer, and the extra fields it
+// writes itself are dropped so they aren't doubled.
+func rewriteHeader(h zip.FileHeader) *zip.FileHeader {
+	h.CRC32 = 0
+	h.CompressedSize, h.CompressedSize64 = 0, 0
+	h.UncompressedSize, h.UncompressedSize64 = 0, 0
+	h.Flags &^= 0x8 // data descriptor, set again by the writer
+	extra, hadTime := stripExtra(h.Extra, zip64ExtraID, extTimeExtraID)
+	h.Extra = extra
+	if !hadTime {
+		// keep the MS-DOS time alone rather than gaining a timestamp field
+		h.Modified = time.Time{}
+	}
+	return &h
+}
+
+const (
+	zip64ExtraID   = 0x0001
+	extTimeExtraID = 0x5455
+)
+
+// stripExtra removes the extra fields with the given IDs, reporting
+// whether an extended timestamp was among them.
+func stripExtra(extra []byte, ids ...uint16) ([]byte, bool) {
+	var out []byte
+	hadTime := false
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			break
+		}
+		field := extra[:4+size]
+		extra = extra[4+size:]
+		drop := false
+		for _, d := range ids {
+			drop = drop || id == d
+		}
+		hadTime = hadTime || id == extTimeExtraID
+		if !drop {
+			out = append(out, field...)
+		}
+	}
+	return out, hadTime
+}
+
+func findPart(parts []*zipPart, name string) *zipPart {
+	for _, p := range parts {
+		if p.Header.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func addPart(parts []*zipPart, name string, data []byte) []*zipPart {
+	if p := findPart(parts, name); p != nil {
+		p.Data = data
+		return parts
+	}
+	h := zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()}
+	return append(parts, &zipPart{Header: h, Data: data})
+}
+
+func parseXML(data []byte) (*etree.Document, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func xmlBytes(doc *etree.Document) ([]byte, error) {
+	for _, c := range doc.Child {
+		if p, ok := c.(*etree.ProcInst); ok && p.Target == "xml" {
+			return doc.WriteToBytes()
+		}
+	}
+	doc.InsertChildAt(0, etree.NewProcInst("xml", `version="1.0" encoding="UTF-8" standalone="yes"`))
+	return doc.WriteToBytes()
+}
+
+const (
+	nsW               = "http://schemas.openxmlformats.org/wordprocessingml/2006/main"
+	nsR               = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	nsRels            = "http://schemas.openxmlformats.org/package/2006/relationships"
+	relOfficeDocument = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument"
+	typeRels          = "application/vnd.openxmlformats-package.relationships+xml"
+	contentTypesPart  = "[Content_Types].xml"
+)
+
+// Package is an Office Open XML document opened for editing. XML parts are
+// edited as etree documents through XML and written back, in the original
+// part order, by Bytes.
+type Package struct {
+	parts   []*zipPart
+	comment string
+	docs    map[string]*etree.Document
+}
+
+func OpenPackage(data []byte) (*Package, error) {
+	parts, comment, err := readParts(data)
+	if err != nil {
+		return nil, err
+	}
+	p := &Package{parts: parts, comment: comment, docs: make(map[string]*etree.Document)}
+	if _, err := p.XML(contentTypesPart); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Package) Has(name string) bool {
+	return findPart(p.parts, name) != nil
+}
+
+// XML returns part name parsed. Changes to it are kept by Bytes.
+func (p *Package) XML(name string) (*etree.Document, error) {
+	if doc, ok := p.docs[name]; ok {
+		return doc, nil
+	}
+	doc, err := p.peek(name)
+	if err != nil {
+		return nil, err
+	}
+	p.docs[name] = doc
+	return doc, nil
+}
+
+// peek parses a part without marking it for writing back.
+func (p *Package) peek(name string) (*etree.Document, error) {
+	if doc, ok := p.docs[name]; ok {
+		return doc, nil
+	}
+	part := findPart(p.parts, name)
+	if part == nil {
+		return nil, fmt.Errorf("%s not found", name)
+	}
+	doc, err := parseXML(part.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return doc, nil
+}
+
+// CreateXML adds an XML part with root as its root element, registering
+// contentType for it unless that is empty.
+func (p *Package) CreateXML(name, contentType string, root *etree.Element) (*etree.Document, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(root)
+	p.parts = addPart(p.parts, name, nil)
+	p.docs[name] = doc
+	if contentType == "" {
+		return doc, nil
+	}
+	return doc, p.AddOverride(name, contentType)
+}
+
+// AddOverride registers the content type of part name.
+func (p *Package) AddOverride(name, contentType string) error {
+	doc, err := p.XML(contentTypesPart)
+	if err != nil {
+		return err
+	}
+	partName := "/" + name
+	for _, o := range doc.Root().SelectElements("Override") {
+		if strings.EqualFold(o.SelectAttrValue("PartName", ""), partName) {
+			return nil
+		}
+	}
+	o := doc.Root().CreateElement("Override")
+	o.CreateAttr("PartName", partName)
+	o.CreateAttr("ContentType", contentType)
+	return nil
+}
+
+// addDefault registers the content type of every part with extension ext
+// that has no override.
+func (p *Package) addDefault(ext, contentType string) error {
+	doc, err := p.XML(contentTypesPart)
+	if err != nil {
+		return err
+	}
+	for _, d := range doc.Root().SelectElements("Default") {
+		if strings.EqualFold(d.SelectAttrValue("Extension", ""), ext) {
+			return nil
+		}
+	}
+	d := etree.NewElement("Default")
+	d.CreateAttr("Extension", ext)
+	d.CreateAttr("ContentType", contentType)
+	// defaults lead the overrides
+	doc.Root().InsertChildAt(0, d)
+	return nil
+}
+
+// relsFor names the relationships part of part name; "" is the package.
+func relsFor(name string) string {
+	if name == "" {
+		return "_rels/.rels"
+	}
+	return path.Join(path.Dir(name), "_rels", path.Base(name)+".rels")
+}
+
+// relsSource is the part the relationships part relsName describes.
+func relsSource(relsName string) string {
+	dir, base := path.Dir(path.Dir(relsName)), strings.TrimSuffix(path.Base(relsName), ".rels")
+	switch {
+	case base == "":
+		return ""
+	case dir == ".":
+		return base
+	}
+	return dir + "/" + base
+}
+
+// resolveTarget turns a relationship target into a part name.
+func resolveTarget(source, target string) string {
+	if strings.HasPrefix(target, "/") {
+		return path.Clean(target[1:])
+	}
+	return path.Clean(path.Join(path.Dir(source), target))
+}
+
+// relativeTarget is the relationship target by which source refers to
+// part, the inverse of resolveTarget. Part names are slash separated
+// whatever the OS, so this works on path, never filepath.
+func relativeTarget(source, part string) string {
+	var from []string
+	if dir := path.Dir(source); dir != "." {
+		from = strings.Split(dir, "/")
+	}
+	to := strings.Split(part, "/")
+	k := 0
+	for k < len(from) && k < len(to)-1 && from[k] == to[k] {
+		k++
+	}
+	return strings.Repeat("../", len(from)-k) + strings.Join(to[k:], "/")
+}
+
+// AddRelationship adds a relationship from part source ("" for the package)
+// unless one of the same type and target exists, returning its ID either
+// way. mode is "External" for targets outside the package, else "".
+func (p *Package) AddRelationship(source, relType, target, mode string) (string, error) {
+	name := relsFor(source)
+	var doc *etree.Document
+	var err error
+	if p.Has(name) {
+		doc, err = p.XML(name)
+	} else {
+		root := etree.NewElement("Relationships")
+		root.CreateAttr("xmlns", nsRels)
+		if doc, err = p.CreateXML(name, "", root); err == nil {
+			err = p.addDefault("rels", typeRels)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	root := doc.Root()
+	ids := make(map[string]bool)
+	for _, r := range root.SelectElements("Relationship") {
+		ids[r.SelectAttrValue("Id", "")] = true
+		if r.SelectAttrValue("Type", "") == relType && r.SelectAttrValue("Target", "") == target {
+			return r.SelectAttrValue("Id", ""), nil
+		}
+	}
+	id := "rIdDlp1"
+	for n := 2; ids[id]; n++ {
+		id = fmt.Sprintf("rIdDlp%d", n)
+	}
+	r := root.CreateElement("Relationship")
+	r.CreateAttr("Id", id)
+	r.CreateAttr("Type", relType)
+	r.CreateAttr("Target", target)
+	if mode != "" {
+		r.CreateAttr("TargetMode", mode)
+	}
+	return id, nil
+}
+
+// RelationshipTarget resolves relationship id of part source to a part
+// name, "" when there is no such internal relationship.
+func (p *Package) RelationshipTarget(source, id string) string {
+	doc, err := p.peek(relsFor(source))
+	if err != nil {
+		return ""
+	}
+	for _, r := range doc.Root().SelectElements("Relationship") {
+		if r.SelectAttrValue("Id", "") == id && r.SelectAttrValue("TargetMode", "") != "External" {
+			return resolveTarget(source, r.SelectAttrValue("Target", ""))
+		}
+	}
+	return ""
+}
+
+// RelatedPart returns the first part source relates to with relType.
+func (p *Package) RelatedPart(source, relType string) string {
+	doc, err := p.peek(relsFor(source))
+	if err != nil {
+		return ""
+	}
+	for _, r := range doc.Root().SelectElements("Relationship") {
+		if r.SelectAttrValue("Type", "") == relType && r.SelectAttrValue("TargetMode", "") != "External" {
+			return resolveTarget(source, r.SelectAttrValue("Target", ""))
+		}
+	}
+	return ""
+}
+
+// MainDocument names the package's main part, word/document.xml in every
+// Word file seen so far.
+func (p *Package) MainDocument() string {
+	if name := p.RelatedPart("", relOfficeDocument); name != "" {
+		return name
+	}
+	return "word/document.xml"
+}
+
+// Bytes writes the edited parts back, checks the result with Validate and
+// returns the new package.
+func (p *Package) Bytes() ([]byte, error) {
+	for name, doc := range p.docs {
+		data, err := xmlBytes(doc)
+		if err != nil {
+			return nil, err
+		}
+		part := findPart(p.parts, name)
+		if part.file != nil && sameXML(part.orig, data) {
+			// parsed but not edited: keep the original bytes
+			continue
+		}
+		part.Data = data
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid package: %w", err)
+	}
+	return writeParts(p.parts, p.comment)
+}
+
+// sameXML reports whether orig serialises to out, i.e. whether a part that
+// was parsed into out is unchanged.
+func sameXML(orig, out []byte) bool {
+	doc, err := parseXML(orig)
+	if err != nil {
+		return false
+	}
+	b, err := xmlBytes(doc)
+	return err == nil && bytes.Equal(b, out)
+}
+
+// Validate checks the structure Word relies on: every part has a content
+// type and parses, overrides and internal relationships point at parts
+// that exist, relationship IDs used in XML parts are defined, and the
+// main document's section properties close its body.
+func (p *Package) Validate() error {
+	var errs []error
+	ct, err := p.peek(contentTypesPart)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for _, part := range p.parts {
+		have[strings.ToLower(part.Header.Name)] = true
+	}
+	defaults := make(map[string]bool)
+	overrides := make(map[string]bool)
+	for _, d := range ct.Root().SelectElements("Default") {
+		defaults[strings.ToLower(d.SelectAttrValue("Extension", ""))] = true
+	}
+	for _, o := range ct.Root().SelectElements("Override") {
+		name := strings.ToLower(strings.TrimPrefix(o.SelectAttrValue("PartName", ""), "/"))
+		overrides[name] = true
+		if !have[name] {
+			errs = append(errs, fmt.Errorf("content type registered for missing part %s", name))
+		}
+	}
+	for _, part := range p.parts {
+		name := part.Header.Name
+		if name == contentTypesPart || strings.HasSuffix(name, "/") {
+			continue
+		}
+		ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+		if !overrides[strings.ToLower(name)] && !defaults[ext] {
+			errs = append(errs, fmt.Errorf("%s has no content type", name))
+		}
+		if ext != "xml" && ext != "rels" {
+			continue
+		}
+		doc, err := p.peek(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ext == "rels" {
+			errs = append(errs, p.checkRels(name, doc, have)...)
+		} else {
+			errs = append(errs, p.checkRelIDs(name, doc)...)
+		}
+	}
+	main := p.MainDocument()
+	if doc, err := p.peek(main); err == nil {
+		if body := doc.Root().SelectElement("w:body"); body != nil {
+			children := body.ChildElements()
+			if s := body.SelectElement("w:sectPr"); s != nil && children[len(children)-1] != s {
+				errs = append(errs, fmt.Errorf("%s: section properties are not the last element of the body", main))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkRels reports internal relationships whose target is missing.
+func (p *Package) checkRels(name string, doc *etree.Document, have map[string]bool) []error {
+	var errs []error
+	source := relsSource(name)
+	for _, r := range doc.Root().SelectElements("Relationship") {
+		if r.SelectAttrValue("TargetMode", "") == "External" {
+			continue
+		}
+		target := resolveTarget(source, r.SelectAttrValue("Target", ""))
+		if !have[strings.ToLower(target)] {
+			errs = append(errs, fmt.Errorf("%s: relationship %s points at missing part %s", name, r.SelectAttrValue("Id", ""), target))
+		}
+	}
+	return errs
+}
+
+// checkRelIDs reports relationship attributes (r:id, r:embed, r:link...)
+// in part name that its relationships part doesn't define.
+func (p *Package) checkRelIDs(name string, doc *etree.Document) []error {
+	ids := make(map[string]bool)
+	if rels, err := p.peek(relsFor(name)); err == nil {
+		for _, r := range rels.Root().SelectElements("Relationship") {
+			ids[r.SelectAttrValue("Id", "")] = true
+		}
+	}
+	var errs []error
+	var walk func(e *etree.Element)
+	walk = func(e *etree.Element) {
+		for _, a := range e.Attr {
+			if a.NamespaceURI() == nsR && !ids[a.Value] {
+				errs = append(errs, fmt.Errorf("%s: %s refers to undefined relationship %s", name, a.FullKey(), a.Value))
+			}
+		}
+		for _, c := range e.ChildElements() {
+			walk(c)
+		}
+	}
+	if doc.Root() != nil {
+		walk(doc.Root())
+	}
+	return errs
+}
+
+// appendToBody adds elements to the end of a Word document's body, ahead
+// of the section properties that must close it. A section properties
+// element something else was appended after, as earlier versions of this
+// program did, is moved back to the end.
+func appendToBody(doc *etree.Document, elems ...*etree.Element) error {
+	body := doc.Root().SelectElement("w:body")
+	if body == nil {
+		return fmt.Errorf("no w:body")
+	}
+	sect := body.SelectElement("w:sectPr")
+	if sect != nil {
+		body.RemoveChild(sect)
+	}
+	for _, e := range elems {
+		body.AddChild(e)
+	}
+	if sect != nil {
+		body.AddChild(sect)
+	}
+	return nil
+}
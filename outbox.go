@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// OutboxEntry is a tag registration that the server hasn't acknowledged yet.
+type OutboxEntry struct {
+	Tag         Tag       `json:"tag"`
+	Seq         int64     `json:"seq"` // tells a re-queued tag from the one being sent
+	Queued      time.Time `json:"queued"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+	NextAttempt time.Time `json:"next_attempt"`
+	// Rejected is set when the server refused the tag. Its beacon will fire
+	// for an ID the server doesn't know, so it is kept for the user to see
+	// and retry rather than dropped.
+	Rejected bool `json:"rejected,omitempty"`
+}
+
+// Outbox persists tag registrations before they are sent and keeps retrying
+// them in the background, so a tag created while offline still reaches the
+// server before its beacon fires.
+//
+// The GUI and CLI runs share the file, so every change is made under a
+// lock file to the queue as last saved, not to this process's copy.
+type Outbox struct {
+	path       string
+	mu         sync.Mutex
+	entries    []OutboxEntry
+	send       func(Tag) error
+	wake       chan struct{}
+	Logger     *log.Logger
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// OnChange is called with the number of pending registrations and how
+	// many of them the server rejected.
+	OnChange func(pending, rejected int)
+}
+
+func DefaultOutboxPath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "outbox.json"), nil
+}
+
+func OpenOutbox(path string, send func(Tag) error, logger *log.Logger) (*Outbox, error) {
+	o := &Outbox{
+		path:       path,
+		send:       send,
+		wake:       make(chan struct{}, 1),
+		Logger:     logger,
+		MinBackoff: 5 * time.Second,
+		MaxBackoff: 10 * time.Minute,
+	}
+	if err := o.reload(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Enqueue stores t on disk and schedules an immediate delivery attempt. A
+// tag that is already queued is replaced rather than duplicated.
+func (o *Outbox) Enqueue(t Tag) error {
+	entry := OutboxEntry{Tag: t, Queued: time.Now(), NextAttempt: time.Now()}
+	err := o.update(func() {
+		entry.Seq = entry.Queued.UnixNano()
+		for _, e := range o.entries {
+			if e.Seq >= entry.Seq {
+				entry.Seq = e.Seq + 1
+			}
+		}
+		if k := o.indexOf(t.ID); k >= 0 {
+			o.entries[k] = entry
+		} else {
+			o.entries = append(o.entries, entry)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	o.Wake()
+	return nil
+}
+
+// Retry queues the rejected registrations again, e.g. once the reason the
+// server gave has been dealt with.
+func (o *Outbox) Retry() error {
+	err := o.update(func() {
+		for k := range o.entries {
+			if e := &o.entries[k]; e.Rejected {
+				e.Rejected, e.Attempts, e.NextAttempt = false, 0, time.Time{}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	o.Wake()
+	return nil
+}
+
+// Wake asks the delivery loop to retry now, e.g. after connectivity returns.
+func (o *Outbox) Wake() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Pending counts the registrations the server hasn't accepted, rejected
+// ones included.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.entries)
+}
+
+func (o *Outbox) Rejected() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.rejected()
+}
+
+func (o *Outbox) rejected() int {
+	n := 0
+	for _, e := range o.entries {
+		if e.Rejected {
+			n++
+		}
+	}
+	return n
+}
+
+// Entries returns a copy of the pending registrations.
+func (o *Outbox) Entries() []OutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]OutboxEntry(nil), o.entries...)
+}
+
+// Run delivers queued tags until ctx is cancelled.
+func (o *Outbox) Run(ctx context.Context) {
+	for {
+		next := o.Flush(ctx)
+		wait := time.Until(next)
+		if next.IsZero() {
+			wait = time.Hour
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-o.wake:
+			timer.Stop()
+			// a wake means "try now", so bring every entry forward
+			err := o.update(func() {
+				for k := range o.entries {
+					o.entries[k].NextAttempt = time.Time{}
+				}
+			})
+			if err != nil {
+				o.Logger.Println("Error saving outbox:", err)
+			}
+		case <-timer.C:
+		}
+	}
+}
+
+// Flush tries every entry that is due and returns when the next one will be.
+// Rejected entries wait for Retry.
+func (o *Outbox) Flush(ctx context.Context) time.Time {
+	// pick up what other processes queued
+	if err := o.reload(); err != nil {
+		o.Logger.Println("Error reading outbox:", err)
+	}
+	for _, e := range o.Entries() {
+		if ctx.Err() != nil {
+			break
+		}
+		if e.Rejected || time.Now().Before(e.NextAttempt) {
+			continue
+		}
+		err := o.send(e.Tag)
+		uerr := o.update(func() {
+			k := o.indexOf(e.Tag.ID)
+			if k < 0 || o.entries[k].Seq != e.Seq {
+				// delivered by another process, or queued again while we
+				// were sending; the new entry goes out on its own
+				return
+			}
+			switch {
+			case err == nil:
+				o.entries = append(o.entries[:k], o.entries[k+1:]...)
+				o.Logger.Println("Tag registered:", e.Tag.ID)
+			case errors.Is(err, ErrRejected):
+				cur := &o.entries[k]
+				cur.Attempts++
+				cur.LastError = err.Error()
+				cur.Rejected = true
+				o.Logger.Printf("Tag %s rejected by the server: %v", e.Tag.ID, err)
+			default:
+				cur := &o.entries[k]
+				cur.Attempts++
+				cur.LastError = err.Error()
+				cur.NextAttempt = time.Now().Add(backoff(cur.Attempts-1, o.MinBackoff, o.MaxBackoff))
+				o.Logger.Printf("Tag %s not registered (attempt %d): %v", e.Tag.ID, cur.Attempts, err)
+			}
+		})
+		if uerr != nil {
+			o.Logger.Println("Error saving outbox:", uerr)
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var next time.Time
+	for _, e := range o.entries {
+		if e.Rejected {
+			continue
+		}
+		if next.IsZero() || e.NextAttempt.Before(next) {
+			next = e.NextAttempt
+		}
+	}
+	return next
+}
+
+func (o *Outbox) indexOf(id string) int {
+	for k := range o.entries {
+		if o.entries[k].Tag.ID == id {
+			return k
+		}
+	}
+	return -1
+}
+
+func (o *Outbox) changed(pending, rejected int) {
+	if o.OnChange != nil {
+		o.OnChange(pending, rejected)
+	}
+}
+
+// reload replaces this process's copy of the queue with the one on disk.
+func (o *Outbox) reload() error {
+	var pending, rejected int
+	err := o.locked(func() error {
+		err := o.load()
+		pending, rejected = len(o.entries), o.rejected()
+		return err
+	})
+	o.changed(pending, rejected)
+	return err
+}
+
+// update applies fn to the queue as last saved, by any process, and saves
+// the result.
+func (o *Outbox) update(fn func()) error {
+	var pending, rejected int
+	err := o.locked(func() error {
+		if err := o.load(); err != nil {
+			return err
+		}
+		fn()
+		pending, rejected = len(o.entries), o.rejected()
+		return o.save()
+	})
+	if err != nil {
+		return err
+	}
+	o.changed(pending, rejected)
+	return nil
+}
+
+// locked runs fn holding o.mu and the lock file shared with other
+// processes.
+func (o *Outbox) locked(fn func() error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	unlock, err := lockFile(o.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn()
+}
+
+// load reads the queue; callers hold the lock.
+func (o *Outbox) load() error {
+	data, err := os.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		o.entries = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []OutboxEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	o.entries = entries
+	return nil
+}
+
+// save writes the queue atomically; callers hold the lock.
+func (o *Outbox) save() error {
+	data, err := json.MarshalIndent(o.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := o.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.path)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+)
+
+func testOutbox(t *testing.T, path string, send func(Tag) error) *Outbox {
+	t.Helper()
+	o, err := OpenOutbox(path, send, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestOutboxShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	failing := func(Tag) error { return fmt.Errorf("offline") }
+	gui := testOutbox(t, path, failing)
+	cli := testOutbox(t, path, failing)
+	if err := gui.Enqueue(Tag{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Enqueue(Tag{ID: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	gui.Flush(context.Background())
+	if got := testOutbox(t, path, failing).Pending(); got != 2 {
+		t.Errorf("%d registrations saved, want both processes' 2", got)
+	}
+}
+
+func TestOutboxRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	o := testOutbox(t, path, func(Tag) error { return fmt.Errorf("%w: bad signature", ErrRejected) })
+	var pending, rejected int
+	o.OnChange = func(p, r int) { pending, rejected = p, r }
+	if err := o.Enqueue(Tag{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	o.Flush(context.Background())
+	if pending != 1 || rejected != 1 {
+		t.Errorf("%d pending, %d rejected, want the rejected tag kept", pending, rejected)
+	}
+	sent := 0
+	o.send = func(Tag) error { sent++; return nil }
+	o.Flush(context.Background())
+	if sent != 0 {
+		t.Error("rejected tag sent again without Retry")
+	}
+	if err := o.Retry(); err != nil {
+		t.Fatal(err)
+	}
+	o.Flush(context.Background())
+	if sent != 1 || o.Pending() != 0 {
+		t.Errorf("sent %d times, %d pending after Retry", sent, o.Pending())
+	}
+}
+
+func TestOutboxRequeuedWhileSending(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	var o *Outbox
+	o = testOutbox(t, path, func(t Tag) error {
+		if t.Label == "" {
+			// the tag changes while its first version is on the wire
+			t.Label = "Internal"
+			o.Enqueue(t)
+		}
+		return nil
+	})
+	if err := o.Enqueue(Tag{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	o.Flush(context.Background())
+	e := o.Entries()
+	if len(e) != 1 || e[0].Tag.Label != "Internal" {
+		t.Fatalf("queue is %+v, want the re-queued tag", e)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Output modes: where a tagged copy goes.
+const (
+	OutputDialog    = "dialog"    // ask with a save dialog
+	OutputInPlace   = "in-place"  // replace the original, keeping it as <name>.bak
+	OutputCopy      = "copy"      // write <name>_tagged next to the original
+	OutputDirectory = "directory" // write <name> into Directory
+)
+
+// ErrSaveCancelled is returned when the user closes the save dialog
+// without choosing a file.
+var ErrSaveCancelled = errors.New("save cancelled")
+
+// OutputConfig is the output policy in config.json.
+type OutputConfig struct {
+	Mode      string `json:"mode"`
+	Suffix    string `json:"suffix,omitempty"`    // for copy, default "_tagged"
+	Directory string `json:"directory,omitempty"` // for directory; a file from this folder gets a copy with Suffix
+}
+
+func DefaultOutput() OutputConfig {
+	return OutputConfig{Mode: OutputDialog, Suffix: "_tagged"}
+}
+
+// Path is where the tagged copy of source is written, "" for the dialog.
+func (c OutputConfig) Path(source string) (string, error) {
+	dir, base := filepath.Split(source)
+	ext := filepath.Ext(base)
+	switch c.Mode {
+	case OutputDialog, "":
+		return "", nil
+	case OutputInPlace:
+		return source, nil
+	case OutputCopy:
+		suffix := c.Suffix
+		if suffix == "" {
+			suffix = DefaultOutput().Suffix
+		}
+		return filepath.Join(dir, strings.TrimSuffix(base, ext)+suffix+ext), nil
+	case OutputDirectory:
+		if c.Directory == "" {
+			return "", fmt.Errorf("output mode %s needs a directory", c.Mode)
+		}
+		if sameDir(c.Directory, dir) {
+			// <name> there is the original; write a copy beside it
+			// instead of overwriting it without a backup
+			return OutputConfig{Mode: OutputCopy, Suffix: c.Suffix}.Path(source)
+		}
+		return filepath.Join(c.Directory, base), nil
+	}
+	return "", fmt.Errorf("unknown output mode %q", c.Mode)
+}
+
+// sameDir reports whether a and b name the same directory.
+func sameDir(a, b string) bool {
+	if a == "" {
+		a = "."
+	}
+	if b == "" {
+		b = "."
+	}
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	sa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	sb, err := os.Stat(b)
+	return err == nil && os.SameFile(sa, sb)
+}
+
+// saveTagged writes the tagged copy of source according to the output
+// policy and calls done with where it went. With the save dialog done is
+// called once the user has answered it.
+func (i *Instance) saveTagged(source string, data []byte, done func(string, error)) {
+	i.saveTaggedAs(i.Config.Output, source, data, done)
+}
+
+// saveTaggedAs is saveTagged with another output policy.
+func (i *Instance) saveTaggedAs(out OutputConfig, source string, data []byte, done func(string, error)) {
+	finish := func(dest string, err error) {
+		if err != nil {
+			i.Logger.Println("Error saving tagged copy:", err)
+		} else {
+			i.Logger.Printf("Tagged copy of %s written to %s", source, dest)
+		}
+		if done != nil {
+			done(dest, err)
+		}
+	}
+	dest, err := out.Path(source)
+	if err != nil {
+		finish("", err)
+		return
+	}
+	if dest == "" {
+		i.offerSave(data, finish)
+		return
+	}
+	if out.Mode == OutputDirectory {
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			finish("", err)
+			return
+		}
+	}
+	if dest == source {
+		err = ReplaceFile(source, data)
+	} else {
+		err = WriteFileAtomic(dest, data, source)
+	}
+	finish(dest, err)
+}
+
+// ReplaceFile atomically replaces path with data, first keeping the
+// current file as path.bak. An existing backup is left alone, so it stays
+// the untagged original when a file is tagged again.
+func ReplaceFile(path string, data []byte) error {
+	bak := path + ".bak"
+	if _, err := os.Lstat(bak); os.IsNotExist(err) {
+		// a hard link keeps the original inode, attributes and all,
+		// without copying it
+		if err := os.Link(path, bak); err != nil {
+			orig, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if err := WriteFileAtomic(bak, orig, path); err != nil {
+				return fmt.Errorf("backup: %w", err)
+			}
+		}
+	}
+	return WriteFileAtomic(path, data, path)
+}
+
+// WriteFileAtomic writes data to a temporary file beside path and renames
+// it into place, so readers see either the old file or the whole new one.
+// The new file takes the permissions, owner and extended attributes of
+// like, when like exists; the owner and attributes are copied as far as
+// the system allows.
+func WriteFileAtomic(path string, data []byte, like string) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	name := tmp.Name()
+	defer os.Remove(name) // no-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(like); err == nil {
+		mode = info.Mode().Perm()
+		copyOwner(info, name)
+		copyXattrs(like, name)
+	}
+	if err := os.Chmod(name, mode); err != nil {
+		return err
+	}
+	if err := os.Rename(name, path); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
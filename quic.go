@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rexlx/dlpeagle/internal/frame"
+)
+
+// ConnState describes where the notification client is in its connect loop.
+type ConnState int32
+
+const (
+	StateOffline ConnState = iota
+	StateConnecting
+	StateLive
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateLive:
+		return "live"
+	default:
+		return "offline"
+	}
+}
+
+// QUICClient keeps a notification session open against the QUIC server. It
+// redials with jittered exponential backoff whenever the session drops and
+// re-registers the client on every new connection. OnNotification is handed
+// each notification with the ack to send once it is stored; the server
+// redelivers what wasn't acked on the next connect, so nothing is lost if
+// we exit first.
+type QUICClient struct {
+	Address        string
+	SM             *SecretManager
+	Logger         *log.Logger
+	Hello          func() Notification // builds the registration message sent after each dial
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+	PingInterval   time.Duration
+	OnNotification func(n Notification, ack func())
+	OnStateChange  func(ConnState)
+	// Prepare runs before every dial, e.g. to enroll and load the TLS
+	// config. An error counts as a failed attempt and is retried with the
+	// same backoff.
+	Prepare func() error
+
+	state atomic.Int32
+	mu    sync.Mutex
+	conn  quic.Connection
+}
+
+func NewQUICClient(address string, sm *SecretManager, logger *log.Logger) *QUICClient {
+	return &QUICClient{
+		Address:      address,
+		SM:           sm,
+		Logger:       logger,
+		MinBackoff:   time.Second,
+		MaxBackoff:   2 * time.Minute,
+		PingInterval: 20 * time.Second,
+	}
+}
+
+func (c *QUICClient) State() ConnState {
+	return ConnState(c.state.Load())
+}
+
+func (c *QUICClient) setState(s ConnState) {
+	if ConnState(c.state.Swap(int32(s))) == s {
+		return
+	}
+	if c.OnStateChange != nil {
+		c.OnStateChange(s)
+	}
+}
+
+// Run blocks until ctx is cancelled, reconnecting as needed.
+func (c *QUICClient) Run(ctx context.Context) {
+	defer c.setState(StateOffline)
+	attempt := 0
+	for {
+		c.setState(StateConnecting)
+		start := time.Now()
+		var err error
+		if c.Prepare != nil {
+			err = c.Prepare()
+		}
+		if err == nil {
+			err = c.session(ctx)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		c.setState(StateOffline)
+		// a session that stayed up for a while resets the backoff so a
+		// single blip doesn't leave us waiting minutes to reconnect.
+		if time.Since(start) > c.MaxBackoff {
+			attempt = 0
+		}
+		wait := backoff(attempt, c.MinBackoff, c.MaxBackoff)
+		attempt++
+		c.Logger.Printf("QUIC session ended: %v (retrying in %v)", err, wait.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Close tears down the current connection, if any. Run will redial unless its
+// context has been cancelled.
+func (c *QUICClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.CloseWithError(0, "terminating")
+		c.conn = nil
+	}
+}
+
+func (c *QUICClient) session(ctx context.Context) error {
+	conn, stream, err := dialQUIC(c.Address, c.SM)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	defer c.Close()
+
+	// unblock the reader when the caller goes away
+	stop := context.AfterFunc(ctx, func() {
+		conn.CloseWithError(0, "terminating")
+	})
+	defer stop()
+
+	fw := frame.NewWriter(stream)
+	var hello Notification
+	if c.Hello != nil {
+		hello = c.Hello()
+	}
+	if err := fw.Write(frame.MsgHello, hello); err != nil {
+		return fmt.Errorf("register: %w", err)
+	}
+	c.setState(StateLive)
+	c.Logger.Println("QUIC session established with", c.Address)
+
+	go c.ping(ctx, conn, fw)
+
+	for {
+		// every ping we send is acked, so a silent stream means the peer is gone
+		if err := stream.SetReadDeadline(time.Now().Add(3 * c.PingInterval)); err != nil {
+			return err
+		}
+		msg, err := frame.ReadMessage(stream)
+		if err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("stream closed by remote")
+			}
+			return err
+		}
+		switch msg.Type {
+		case frame.MsgNotification:
+			var not Notification
+			if err := msg.Decode(&not); err != nil {
+				c.Logger.Println("Error unmarshalling notification:", err)
+				continue
+			}
+			ack := func() {
+				if err := fw.Write(frame.MsgAck, frame.Ack{ID: not.ID}); err != nil {
+					c.Logger.Printf("Error acking %s, it will be redelivered: %v", not.ID, err)
+				}
+			}
+			if c.OnNotification == nil {
+				ack()
+				continue
+			}
+			c.OnNotification(not, ack)
+		case frame.MsgPing:
+			if err := fw.Write(frame.MsgAck, frame.Ack{}); err != nil {
+				return err
+			}
+		case frame.MsgAck, frame.MsgHello:
+			// nothing to do; acks confirm our hello and pings
+		}
+	}
+}
+
+// ping sends keepalives until the connection goes away.
+func (c *QUICClient) ping(ctx context.Context, conn quic.Connection, fw *frame.Writer) {
+	t := time.NewTicker(c.PingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-conn.Context().Done():
+			return
+		case <-t.C:
+			if err := fw.Write(frame.MsgPing, frame.Ack{}); err != nil {
+				c.Logger.Println("Error sending ping:", err)
+				return
+			}
+		}
+	}
+}
+
+// backoff returns a full-jitter exponential delay for the given attempt,
+// never more than max.
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	d := min
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return min
+	}
+	if w := min/2 + time.Duration(rand.Int63n(int64(d))); w < max {
+		return w
+	}
+	return max
+}
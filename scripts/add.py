@@ -1,36 +1,97 @@
+import argparse
+import math
 import pikepdf
-import sys
 import os
 
-def add_url_action(pdf_path, output_path, page_number, x, y, width, height, url):
-    with pikepdf.open(pdf_path) as pdf:
-        page = pdf.pages[page_number]
+def add_url_action(pdf, page_number, x, y, width, height, url):
+    page = pdf.pages[page_number]
 
-        # Create the annotation dictionary directly.
-        annot = pikepdf.Dictionary(
-            Subtype=pikepdf.Name('/Link'),
-            Rect=[x, y, x + width, y + height],
-            A=pikepdf.Dictionary(S=pikepdf.Name('/URI'), URI=url)
-        )
+    # Create the annotation dictionary directly.
+    annot = pikepdf.Dictionary(
+        Subtype=pikepdf.Name('/Link'),
+        Rect=[x, y, x + width, y + height],
+        A=pikepdf.Dictionary(S=pikepdf.Name('/URI'), URI=url)
+    )
 
-        # Append the dictionary to the page's annotations.
-        if "/Annots" in page:
-            page["/Annots"].append(annot)
-        else:
-            page["/Annots"] = pikepdf.Array([annot])
+    # Append the dictionary to the page's annotations.
+    if "/Annots" in page:
+        page["/Annots"].append(annot)
+    else:
+        page["/Annots"] = pikepdf.Array([annot])
 
-        pdf.save(output_path)
+def add_label(pdf, label):
+    # xmp:Label is the XMP basic property for a user defined classification;
+    # the info dictionary copy is for readers that ignore XMP.
+    with pdf.open_metadata(set_pikepdf_as_editor=False) as meta:
+        meta['xmp:Label'] = label
+    pdf.docinfo['/Classification'] = label
+
+def add_marking(pdf, text, size=10):
+    font = pdf.make_indirect(pikepdf.Dictionary(
+        Type=pikepdf.Name.Font,
+        Subtype=pikepdf.Name.Type1,
+        BaseFont=pikepdf.Name('/Helvetica-Bold'),
+        Encoding=pikepdf.Name.WinAnsiEncoding,
+    ))
+    escaped = text.replace('\\', '\\\\').replace('(', '\\(').replace(')', '\\)')
+    for page in pdf.pages:
+        name = page.add_resource(font, pikepdf.Name.Font, prefix='DLP')
+        x0, y0, x1, y1 = [float(v) for v in page.mediabox]
+        width = len(text) * size * 0.6  # rough Helvetica advance
+        x = x0 + (x1 - x0 - width) / 2
+        y = y1 - 2 * size
+        # wrap the existing content so its graphics state can't move the label
+        page.contents_add(pikepdf.Stream(pdf, b'q\n'), prepend=True)
+        ops = f'\nQ q BT {name} {size} Tf 0.75 0 0 rg {x:.2f} {y:.2f} Td ({escaped}) Tj ET Q\n'
+        page.contents_add(pikepdf.Stream(pdf, ops.encode('cp1252', 'replace')), prepend=False)
+
+def add_watermark(pdf, text, opacity=0.25):
+    font = pdf.make_indirect(pikepdf.Dictionary(
+        Type=pikepdf.Name.Font,
+        Subtype=pikepdf.Name.Type1,
+        BaseFont=pikepdf.Name('/Helvetica-Bold'),
+        Encoding=pikepdf.Name.WinAnsiEncoding,
+    ))
+    alpha = pdf.make_indirect(pikepdf.Dictionary(Type=pikepdf.Name.ExtGState, ca=opacity, CA=opacity))
+    escaped = text.replace('\\', '\\\\').replace('(', '\\(').replace(')', '\\)')
+    for page in pdf.pages:
+        fname = page.add_resource(font, pikepdf.Name.Font, prefix='DLP')
+        gname = page.add_resource(alpha, pikepdf.Name.ExtGState, prefix='DLP')
+        x0, y0, x1, y1 = [float(v) for v in page.mediabox]
+        w, h = x1 - x0, y1 - y0
+        angle = math.atan2(h, w)
+        # fit the text along 80% of the diagonal
+        size = min(72, 0.8 * math.hypot(w, h) / (len(text) * 0.6))
+        c, s = math.cos(angle), math.sin(angle)
+        tw = len(text) * size * 0.6
+        # start so the middle of the text sits on the page centre
+        tx = x0 + w / 2 - c * tw / 2 + s * size / 3
+        ty = y0 + h / 2 - s * tw / 2 - c * size / 3
+        page.contents_add(pikepdf.Stream(pdf, b'q\n'), prepend=True)
+        ops = (f'\nQ q {gname} gs BT {fname} {size:.2f} Tf 0.5 0.5 0.5 rg '
+               f'{c:.4f} {s:.4f} {-s:.4f} {c:.4f} {tx:.2f} {ty:.2f} Tm ({escaped}) Tj ET Q\n')
+        page.contents_add(pikepdf.Stream(pdf, ops.encode('cp1252', 'replace')), prepend=False)
 
 if __name__ == "__main__":
-    if len(sys.argv) != 2:
-        print("Usage: python script.py <input_pdf_path>")
-        sys.exit(1)
+    parser = argparse.ArgumentParser(description="Add a tracking link, and optionally a classification label, to a PDF.")
+    parser.add_argument("pdf_path")
+    parser.add_argument("url", nargs="?", default="http://fairlady:8081/okay")
+    parser.add_argument("--label", help="classification written to the XMP and info metadata")
+    parser.add_argument("--marking", help="text drawn at the top of every page")
+    parser.add_argument("--watermark", help="text drawn diagonally across every page")
+    args = parser.parse_args()
 
-    pdf_path = sys.argv[1]
-    output_path = os.path.splitext(pdf_path)[0] + "_new.pdf"
+    output_path = os.path.splitext(args.pdf_path)[0] + "_new.pdf"
     page_number = 0  # Page index (0-based)
     x, y, width, height = 100, 700, 200, 50  # Coordinates and size of the clickable area
-    url = "http://fairlady:8081/okay"
 
-    add_url_action(pdf_path, output_path, page_number, x, y, width, height, url)
-    print(f"Modified PDF saved to: {output_path}")
\ No newline at end of file
+    with pikepdf.open(args.pdf_path) as pdf:
+        add_url_action(pdf, page_number, x, y, width, height, args.url)
+        if args.label:
+            add_label(pdf, args.label)
+        if args.marking:
+            add_marking(pdf, args.marking)
+        if args.watermark:
+            add_watermark(pdf, args.watermark)
+        pdf.save(output_path)
+    print(f"Modified PDF saved to: {output_path}")
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TagClaims is what a device signs for each tag. It is serialised into the
+// compact token registered with the tag, so keep the field names short.
+type TagClaims struct {
+	ID         string `json:"id"`
+	Username   string `json:"u"`
+	ClientID   string `json:"c"`
+	Created    int    `json:"t"`
+	Hash       string `json:"h,omitempty"` // original file hash
+	TaggedHash string `json:"th,omitempty"`
+	FilePath   string `json:"f,omitempty"`
+	Label      string `json:"l,omitempty"`
+	ParentID   string `json:"p,omitempty"`
+	Recipient  string `json:"r,omitempty"`
+	Key        string `json:"k"` // signer's public key, base64url
+}
+
+var b64 = base64.RawURLEncoding
+
+var ErrBadSignature = errors.New("tag signature does not verify")
+
+func DefaultDeviceKeyPath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "device.key"), nil
+}
+
+// LoadOrCreateDeviceKey returns this device's Ed25519 signing key,
+// generating it on first use.
+func LoadOrCreateDeviceKey(path string) (ed25519.PrivateKey, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no key in %s", path)
+		}
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an ed25519 key", path)
+		}
+		return key, nil
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DefaultTrustedDevicesPath is where offline verification looks up other
+// clients' keys: a copy of the server's devices.json.
+func DefaultTrustedDevicesPath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "trusted_devices.json"), nil
+}
+
+// LoadTrustedDevices reads a devices.json as the server writes it and
+// returns each client ID's key.
+func LoadTrustedDevices(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var devices map[string]struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(data, &devices); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]string, len(devices))
+	for id, d := range devices {
+		keys[id] = d.Key
+	}
+	return keys, nil
+}
+
+// trustedKey reports whether key is known offline to belong to clientID:
+// it is this device's own key, or it is listed in trusted_devices.json.
+func (i *Instance) trustedKey(clientID, key string) bool {
+	if i.DeviceKey != nil && key == PublicKeyString(i.DeviceKey.Public().(ed25519.PublicKey)) {
+		own, err := GetClientID()
+		return err == nil && own == clientID
+	}
+	path, err := DefaultTrustedDevicesPath()
+	if err != nil {
+		return false
+	}
+	keys, err := LoadTrustedDevices(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			i.Logger.Println("Error reading trusted devices:", err)
+		}
+		return false
+	}
+	return keys[clientID] == key
+}
+
+// PublicKeyString encodes a public key the way tags carry it.
+func PublicKeyString(pub ed25519.PublicKey) string {
+	return b64.EncodeToString(pub)
+}
+
+// SignTag fills in t.PublicKey and t.Signature. The signature is a compact
+// token, base64url(claims) "." base64url(sig), that can be verified from
+// the token alone. It covers the tagged copy's hash, so t is signed once the
+// copy exists.
+func SignTag(t *Tag, key ed25519.PrivateKey) error {
+	pub := key.Public().(ed25519.PublicKey)
+	claims, err := json.Marshal(TagClaims{
+		ID:         t.ID,
+		Username:   t.Username,
+		ClientID:   t.ClientID,
+		Created:    t.Created,
+		Hash:       t.OriginalHash,
+		TaggedHash: t.TaggedHash,
+		FilePath:   t.FilePath,
+		Label:      t.Label,
+		ParentID:   t.ParentID,
+		Recipient:  t.Recipient,
+		Key:        PublicKeyString(pub),
+	})
+	if err != nil {
+		return err
+	}
+	payload := b64.EncodeToString(claims)
+	sig := ed25519.Sign(key, []byte(payload))
+	t.PublicKey = PublicKeyString(pub)
+	t.Signature = payload + "." + b64.EncodeToString(sig)
+	return nil
+}
+
+// VerifyToken checks a compact token's signature against the key it names
+// and returns its claims.
+func VerifyToken(token string) (TagClaims, error) {
+	var c TagClaims
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return c, ErrBadSignature
+	}
+	raw, err := b64.DecodeString(payload)
+	if err != nil {
+		return c, ErrBadSignature
+	}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return c, ErrBadSignature
+	}
+	pub, err := b64.DecodeString(c.Key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return c, ErrBadSignature
+	}
+	s, err := b64.DecodeString(sig)
+	if err != nil || !ed25519.Verify(pub, []byte(payload), s) {
+		return c, ErrBadSignature
+	}
+	return c, nil
+}
+
+// VerifyTag checks that t.Signature is valid, was made with t.PublicKey and
+// covers t's own fields, and that t.BeaconSignature was made with the same
+// key.
+func VerifyTag(t Tag) error {
+	c, err := VerifyToken(t.Signature)
+	if err != nil {
+		return err
+	}
+	if c.Key != t.PublicKey || c.ID != t.ID || c.Username != t.Username ||
+		c.ClientID != t.ClientID || c.Created != t.Created || c.Hash != t.OriginalHash ||
+		c.TaggedHash != t.TaggedHash || c.FilePath != t.FilePath || c.Label != t.Label ||
+		c.ParentID != t.ParentID || c.Recipient != t.Recipient {
+		return fmt.Errorf("%w: claims don't match tag %s", ErrBadSignature, t.ID)
+	}
+	if !VerifyBeacon(t.ID, t.ClientID, t.BeaconSignature, t.PublicKey) {
+		return fmt.Errorf("%w: beacon signature of tag %s", ErrBadSignature, t.ID)
+	}
+	return nil
+}
+
+// beaconMessage is what a beacon signature signs. The beacon goes into the
+// document before the tagged copy's hash is known, so it can't carry the
+// tag's claims; it names the tag and the client that issued it, which is
+// enough to tell who tagged a document without asking the server.
+func beaconMessage(id, clientID string) []byte {
+	return []byte("dlpeagle beacon " + id + " " + clientID)
+}
+
+// SignEnrollment signs an enrollment's PEM CSR, proving to the server that
+// the enrolling client holds the device key it binds.
+func SignEnrollment(csr []byte, key ed25519.PrivateKey) string {
+	return b64.EncodeToString(ed25519.Sign(key, append([]byte("dlpeagle enroll "), csr...)))
+}
+
+// SignRevocation signs a request to revoke tag id; the server only takes it
+// from the device that signed the tag.
+func SignRevocation(id string, key ed25519.PrivateKey) string {
+	return b64.EncodeToString(ed25519.Sign(key, []byte("dlpeagle revoke "+id)))
+}
+
+// SignBeacon returns the signature carried by the beacon for tag id issued
+// by clientID.
+func SignBeacon(id, clientID string, key ed25519.PrivateKey) string {
+	return b64.EncodeToString(ed25519.Sign(key, beaconMessage(id, clientID)))
+}
+
+// VerifyBeacon checks a beacon signature for tag id issued by clientID
+// against a public key as tags carry it.
+func VerifyBeacon(id, clientID, sig, key string) bool {
+	pub, err := b64.DecodeString(key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	s, err := b64.DecodeString(sig)
+	return err == nil && ed25519.Verify(pub, beaconMessage(id, clientID), s)
+}
+
+// KeyFingerprint shortens a public key, as tags carry it, for display.
+func KeyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// beaconParams is what a signed beacon carries besides the tag ID: the
+// signature (t), the client that made it (c) and its public key (k), so
+// the signature can be checked offline, see VerifyFileOffline.
+func beaconParams(t Tag) url.Values {
+	params := url.Values{}
+	if t.BeaconSignature != "" {
+		params.Set("t", t.BeaconSignature)
+		params.Set("c", t.ClientID)
+		params.Set("k", t.PublicKey)
+	}
+	return params
+}
+
+// beaconURL builds the tracker URL for t.
+func (i *Instance) beaconURL(t Tag) string {
+	u := fmt.Sprintf("%v/%v", i.API.URL, t.ID)
+	if params := beaconParams(t); len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	return u
+}
+
+// signBeacon fills in t.BeaconSignature and the key it can be checked
+// with, if a device key is loaded.
+func (i *Instance) signBeacon(t *Tag) {
+	if i.DeviceKey != nil {
+		t.PublicKey = PublicKeyString(i.DeviceKey.Public().(ed25519.PublicKey))
+		t.BeaconSignature = SignBeacon(t.ID, t.ClientID, i.DeviceKey)
+	}
+}
+
+// signTag signs t with the device key if one is loaded. t must be final:
+// the signature covers the tagged copy's hash.
+func (i *Instance) signTag(t *Tag) {
+	if i.DeviceKey == nil {
+		return
+	}
+	if err := SignTag(t, i.DeviceKey); err != nil {
+		i.Logger.Println("Error signing tag:", err)
+	}
+}
@@ -7,12 +7,16 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type Storage interface {
-	SavePDF(file []byte, name string, uid string) (string, error)
+	// SavePDF uploads a PDF for the server to add t's beacon, label and
+	// watermark to, and returns where the tagged copy can be fetched.
+	SavePDF(file []byte, name string, t Tag) (string, error)
 	SaveImage(file []byte, name string) (string, error)
 	SaveHTML(file []byte, name string) (string, error)
 	// GetPDF(name string) ([]byte, error)
@@ -42,6 +46,8 @@ type HttpStorage struct {
 	AccessKey string
 	SecretKey string
 	Bucket    string
+	Username  string // the server's API credentials
+	Password  string
 }
 
 type LocalStorage struct {
@@ -54,25 +60,31 @@ type MinioStorage struct{}
 type uploadStatus struct {
 	Status string `json:"status"`
 	ID     string `json:"id"`
+	URL    string `json:"url,omitempty"` // where the tagged copy can be fetched, once complete
 }
 
-func (h *HttpStorage) saveFile(file []byte, name, uid string) (string, error) {
+// saveFile uploads file in chunks. params go with the last chunk.
+func (h *HttpStorage) saveFile(file []byte, name, uid string, params url.Values) (string, error) {
 	chunkSize := 1024 * 1024 // 1 MB
 	url := h.Endpoint + "/upload"
 	var lastChunk bool
 	client := &http.Client{}
 	for i := 0; i < len(file); i += chunkSize {
 		end := i + chunkSize
-		if end > len(file) {
+		if end >= len(file) {
 			end = len(file)
 			lastChunk = true
 		}
-		req, err := http.NewRequest("POST", url, nil)
+		target := url
+		if lastChunk && len(params) > 0 {
+			target += "?" + params.Encode()
+		}
+		req, err := http.NewRequest("POST", target, nil)
 		if err != nil {
 			return "", err
 		}
 		req.Header.Set("Content-Type", "application/octet-stream")
-		req.Header.Set("Authorization", "AWS "+h.AccessKey+":"+h.SecretKey)
+		req.SetBasicAuth(h.Username, h.Password)
 		req.Header.Set("X-filename", name)
 		req.Header.Set("X-ID", uid)
 		if lastChunk {
@@ -89,35 +101,33 @@ func (h *HttpStorage) saveFile(file []byte, name, uid string) (string, error) {
 		}
 		var status uploadStatus
 		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				return "", fmt.Errorf("failed to read response body: %w", err)
-			}
-			fmt.Println("failed to decode response", url, err, len(body))
-			return "", fmt.Errorf("failed to decode response: body: %s", resp.Status)
+			return "", fmt.Errorf("failed to decode response: %w", err)
 		}
 		if status.Status == "complete" {
-			modifiedFilenameWithoutExt := name[:len(name)-len(filepath.Ext(name))]
-			modifiedFilename := modifiedFilenameWithoutExt + "_new.pdf"
-			newPdfURL := fmt.Sprintf("%s/static/%s", h.Endpoint, modifiedFilename)
-			fmt.Println("Upload complete", newPdfURL)
-			return newPdfURL, nil
-
+			// the tagged copy is private to us and fetched with the same
+			// credentials
+			return strings.TrimRight(h.Endpoint, "/") + status.URL, nil
 		}
 	}
 	return "", nil
 }
 
-func (h *HttpStorage) SavePDF(file []byte, name string, uid string) (string, error) {
-	return h.saveFile(file, name, uid)
+func (h *HttpStorage) SavePDF(file []byte, name string, t Tag) (string, error) {
+	params := beaconParams(t)
+	for k, v := range map[string]string{"label": t.Label, "marking": t.Marking, "watermark": t.Watermark} {
+		if v != "" {
+			params.Set(k, v)
+		}
+	}
+	return h.saveFile(file, name, t.ID, params)
 }
 
 func (h *HttpStorage) SaveImage(file []byte, name string) (string, error) {
-	return h.saveFile(file, name, "image")
+	return h.saveFile(file, name, "image", nil)
 }
 
 func (h *HttpStorage) SaveHTML(file []byte, name string) (string, error) {
-	return h.saveFile(file, name, "html")
+	return h.saveFile(file, name, "html", nil)
 }
 
 func (h *HttpStorage) getFile(name, fileType string) ([]byte, error) {
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/rexlx/dlpeagle/internal/frame"
+)
+
+// TagRecord is a tag created on this machine as stored on disk.
+type TagRecord struct {
+	Tag
+	Output string `json:"output,omitempty"` // where the tagged copy was saved
+}
+
+// tagDBRecord is one line of the journal. Op is "put", "output" or
+// "revoke".
+type tagDBRecord struct {
+	Op     string     `json:"op"`
+	ID     string     `json:"id,omitempty"`
+	Output string     `json:"output,omitempty"`
+	Entry  *TagRecord `json:"entry,omitempty"`
+}
+
+// TagDB is an append-only JSONL journal of the tags created here, so they
+// can be listed after a restart. Puts, saves and revocations are appended;
+// the file is rewritten once most of its records are stale.
+type TagDB struct {
+	path    string
+	mu      sync.Mutex
+	entries []TagRecord // oldest first
+	index   map[string]int
+	hashes  map[string]bool // hashes of tagged copies
+	records int
+}
+
+func DefaultTagDBPath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tags.jsonl"), nil
+}
+
+// OpenTagDB replays the journal at path, creating it if needed.
+func OpenTagDB(path string) (*TagDB, error) {
+	db := &TagDB{path: path, index: make(map[string]int), hashes: make(map[string]bool)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), frame.MaxSize)
+	for sc.Scan() {
+		var rec tagDBRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			// a torn final line from a crash shouldn't lose the rest
+			continue
+		}
+		db.records++
+		db.apply(rec)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *TagDB) apply(rec tagDBRecord) {
+	switch rec.Op {
+	case "put":
+		if rec.Entry == nil {
+			return
+		}
+		if h := rec.Entry.TaggedHash; h != "" {
+			db.hashes[h] = true
+		}
+		if k, ok := db.index[rec.Entry.ID]; ok {
+			// a tag is put again once its tagged copy exists; keep
+			// what we already know about where it went
+			e := *rec.Entry
+			if e.Output == "" {
+				e.Output = db.entries[k].Output
+			}
+			e.Revoked = e.Revoked || db.entries[k].Revoked
+			db.entries[k] = e
+			return
+		}
+		db.index[rec.Entry.ID] = len(db.entries)
+		db.entries = append(db.entries, *rec.Entry)
+	case "output":
+		if k, ok := db.index[rec.ID]; ok {
+			db.entries[k].Output = rec.Output
+		}
+	case "revoke":
+		if k, ok := db.index[rec.ID]; ok {
+			db.entries[k].Revoked = true
+		}
+	}
+}
+
+// Put stores t, replacing an earlier version of it.
+func (db *TagDB) Put(t Tag) error {
+	return db.record(tagDBRecord{Op: "put", Entry: &TagRecord{Tag: t}})
+}
+
+// SetOutput records where the tagged copy of tag id was saved.
+func (db *TagDB) SetOutput(id, path string) error {
+	return db.record(tagDBRecord{Op: "output", ID: id, Output: path})
+}
+
+// Revoke marks tag id as revoked.
+func (db *TagDB) Revoke(id string) error {
+	return db.record(tagDBRecord{Op: "revoke", ID: id})
+}
+
+func (db *TagDB) Get(id string) (TagRecord, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	k, ok := db.index[id]
+	if !ok {
+		return TagRecord{}, false
+	}
+	return db.entries[k], true
+}
+
+// HasTaggedHash reports whether hash is that of a tagged copy made here.
+func (db *TagDB) HasTaggedHash(hash string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.hashes[hash]
+}
+
+// All returns every stored tag, newest first.
+func (db *TagDB) All() []TagRecord {
+	db.mu.Lock()
+	out := append([]TagRecord(nil), db.entries...)
+	db.mu.Unlock()
+	sort.SliceStable(out, func(a, b int) bool { return out[a].Created > out[b].Created })
+	return out
+}
+
+func (db *TagDB) record(rec tagDBRecord) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if rec.Op != "put" {
+		if _, ok := db.index[rec.ID]; !ok {
+			return nil
+		}
+	}
+	out, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(db.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(out, '\n')); err != nil {
+		return err
+	}
+	db.records++
+	db.apply(rec)
+	return db.maybeCompact()
+}
+
+// maybeCompact rewrites the journal once it holds twice as many records as
+// there are tags.
+func (db *TagDB) maybeCompact() error {
+	if db.records < 100 || db.records < 2*len(db.entries) {
+		return nil
+	}
+	tmp := db.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for k := range db.entries {
+		if err := enc.Encode(tagDBRecord{Op: "put", Entry: &db.entries[k]}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, db.path); err != nil {
+		return err
+	}
+	db.records = len(db.entries)
+	return nil
+}
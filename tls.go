@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rexlx/dlpeagle/internal/frame"
+)
+
+// TLSFiles locates the pinned server CA and this client's enrolled keypair.
+type TLSFiles struct {
+	CA   string `json:"ca"`
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// ConfigDir is where dlpeagle keeps per-user state such as certificates.
+func ConfigDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "dlpeagle")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func DefaultLogPath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "instance.log"), nil
+}
+
+// DefaultInvitePath is where "dlpeagle enroll" keeps the server's invite
+// until enrollment succeeds.
+func DefaultInvitePath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "enroll.token"), nil
+}
+
+func DefaultTLSFiles() (TLSFiles, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return TLSFiles{}, err
+	}
+	return TLSFiles{
+		CA:   filepath.Join(dir, "ca.pem"),
+		Cert: filepath.Join(dir, "client.pem"),
+		Key:  filepath.Join(dir, "client.key"),
+	}, nil
+}
+
+// LoadTLS builds the QUIC TLS config. Only the CA in files.CA is trusted, so
+// a server presenting any other chain is rejected even if the system trusts it.
+func (sm *SecretManager) LoadTLS(files TLSFiles, address string) error {
+	caPEM, err := os.ReadFile(files.CA)
+	if err != nil {
+		return fmt.Errorf("pinned CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("pinned CA: no certificates in %s", files.CA)
+	}
+	cert, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+	if err != nil {
+		return fmt.Errorf("client certificate: %w", err)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	sm.TC = &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{frame.ALPN},
+		ServerName:   host,
+		MinVersion:   tls.VersionTLS13,
+	}
+	return nil
+}
+
+// SetupTLS enrolls if needed and loads the mutual TLS config for the
+// notification channel.
+func (i *Instance) SetupTLS() error {
+	if err := i.Enroll(i.TLS); err != nil {
+		return err
+	}
+	return i.SM.LoadTLS(i.TLS, i.QUICAddress)
+}
+
+// Enroll makes sure this client has a certificate for mutual TLS. On first
+// run it generates a key, sends a CSR to the server's /enroll endpoint and
+// stores the signed certificate next to the key. The certificate names the
+// client ID, which the server binds to our account and device key, so a
+// certificate issued for another name is replaced. The first enrollment
+// needs the invite saved by "dlpeagle enroll", which is removed once used.
+func (i *Instance) Enroll(files TLSFiles) error {
+	i.enrollMu.Lock()
+	defer i.enrollMu.Unlock()
+	cn, err := GetClientID()
+	if err != nil {
+		return err
+	}
+	if FileExists(files.Key) && certName(files.Cert) == cn {
+		return nil
+	}
+	if i.DeviceKey == nil {
+		return errors.New("enroll: no device key to bind")
+	}
+	key, err := loadOrCreateKey(files.Key)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cn},
+	}, key)
+	if err != nil {
+		return err
+	}
+	body := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})
+	pub := PublicKeyString(i.DeviceKey.Public().(ed25519.PublicKey))
+	var invite string
+	invitePath, err := DefaultInvitePath()
+	if err == nil {
+		if data, err := os.ReadFile(invitePath); err == nil {
+			invite = strings.TrimSpace(string(data))
+		}
+	}
+	certPEM, err := i.Client.Enroll(context.Background(), body, pub, SignEnrollment(body, i.DeviceKey), invite)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.New("enroll: server did not return a certificate")
+	}
+	if err := os.WriteFile(files.Cert, certPEM, 0644); err != nil {
+		return err
+	}
+	if invite != "" {
+		os.Remove(invitePath)
+	}
+	i.Logger.Println("Enrolled client certificate for", cn)
+	return nil
+}
+
+// certName returns the common name of the PEM certificate at path, or ""
+// if there is none.
+func certName(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return ""
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// loadOrCreateKey reuses a key left behind by an earlier, failed enrollment
+// so the server never sees more than one CSR key per client.
+func loadOrCreateKey(path string) (*ecdsa.PrivateKey, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no key in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, out, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
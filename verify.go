@@ -0,0 +1,510 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// BeaconRef is a tag ID found inside a document and where it was found.
+type BeaconRef struct {
+	ID       string `json:"id"`
+	Location string `json:"location"`           // part or section of the file
+	URL      string `json:"url,omitempty"`      // beacon URL when the ID was part of one
+	Strategy string `json:"strategy,omitempty"` // Word beacon strategy that placed it
+}
+
+// TagCheck is the server's view of one embedded tag ID.
+type TagCheck struct {
+	ID         string `json:"id"`
+	Registered bool   `json:"registered"`
+	Tag        Tag    `json:"tag"`
+	HashMatch  bool   `json:"hash_match"`
+	Error      string `json:"error,omitempty"`
+	// Signer is the client ID of a registered tag whose signature checks
+	// out; the server only accepts signatures by the key enrolled for that
+	// client. Empty for an unsigned tag, whose client ID is just a claim.
+	Signer string `json:"signer,omitempty"`
+	// BeaconClient is the client ID a signed beacon names, its signature
+	// checked offline against the key it carries, fingerprinted in
+	// BeaconKey. KeyTrusted is set when that key is known to be the
+	// client's without asking the server.
+	BeaconClient string `json:"beacon_client,omitempty"`
+	BeaconKey    string `json:"beacon_key,omitempty"`
+	KeyTrusted   bool   `json:"key_trusted,omitempty"`
+}
+
+// Verification answers "is this file tagged, by whom, and is the tag intact?"
+type Verification struct {
+	Path     string      `json:"path"`
+	Hash     string      `json:"hash"`
+	Beacons  []BeaconRef `json:"beacons"`
+	Tags     []TagCheck  `json:"tags"`
+	Stripped bool        `json:"stripped"` // no beacon left, but the server knows this file
+	Tampered bool        `json:"tampered"` // beacon present but altered or unknown
+	Offline  bool        `json:"offline"`  // checked without the server, see VerifyFileOffline
+	Problems []string    `json:"problems,omitempty"`
+}
+
+// Tagged reports whether at least one registered tag was found or, offline,
+// a beacon signed with a trusted key.
+func (v Verification) Tagged() bool {
+	for _, t := range v.Tags {
+		if t.Registered || (v.Offline && t.KeyTrusted) {
+			return true
+		}
+	}
+	return false
+}
+
+// OK is true for a tagged file with nothing suspicious about it.
+func (v Verification) OK() bool {
+	return v.Tagged() && !v.Stripped && !v.Tampered
+}
+
+func (v *Verification) problem(format string, args ...any) {
+	v.Problems = append(v.Problems, fmt.Sprintf(format, args...))
+}
+
+var (
+	uuidPattern = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}`)
+	urlPattern  = regexp.MustCompile(`https?://[^\s"'<>()\\]+`)
+	// beacon URLs in attributes and text have their XML escapes undone
+	// before scanning so &quot; and &amp; don't end up in them
+	xmlUnescaper = strings.NewReplacer("&quot;", `"`, "&apos;", "'", "&lt;", "<", "&gt;", ">", "&amp;", "&")
+)
+
+// ExtractBeacons finds every tag ID embedded in the file at path. Word
+// documents are searched part by part so the location is meaningful; PDFs
+// are scanned as raw bytes and stream by stream, so link annotations inside
+// compressed object streams are found too; other formats are scanned as
+// raw bytes.
+func ExtractBeacons(path string) ([]BeaconRef, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".docx":
+		return extractDocxBeacons(path)
+	case ".pdf":
+		return extractPDFBeacons(path)
+	default:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return scanBeacons(string(data), filepath.Base(path)), nil
+	}
+}
+
+func extractDocxBeacons(path string) ([]BeaconRef, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var refs []BeaconRef
+	for _, f := range r.File {
+		if !strings.HasSuffix(f.Name, ".xml") && !strings.HasSuffix(f.Name, ".rels") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		found := scanBeacons(xmlUnescaper.Replace(string(data)), f.Name)
+		if s := beaconLocationStrategy(f.Name); s != "" {
+			for k := range found {
+				if found[k].URL != "" {
+					found[k].Strategy = s
+				}
+			}
+		}
+		refs = append(refs, found...)
+	}
+	return refs, nil
+}
+
+func extractPDFBeacons(path string) ([]BeaconRef, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(path)
+	found := scanBeacons(string(data), name)
+	for k, stream := range pdfStreams(data) {
+		found = append(found, scanBeacons(string(stream), fmt.Sprintf("%s stream %d", name, k+1))...)
+	}
+	// an uncompressed stream is seen both ways
+	var refs []BeaconRef
+	seen := make(map[BeaconRef]bool)
+	for _, b := range found {
+		key := BeaconRef{ID: b.ID, URL: b.URL}
+		if !seen[key] {
+			seen[key] = true
+			refs = append(refs, b)
+		}
+	}
+	return refs, nil
+}
+
+// scanBeacons reports each UUID in text, attaching the URL it sits in when
+// there is one.
+func scanBeacons(text, location string) []BeaconRef {
+	var refs []BeaconRef
+	seen := make(map[string]bool)
+	for _, u := range urlPattern.FindAllString(text, -1) {
+		if id := uuidPattern.FindString(u); id != "" && !seen[id] {
+			seen[id] = true
+			refs = append(refs, BeaconRef{ID: id, Location: location, URL: u})
+		}
+	}
+	for _, id := range uuidPattern.FindAllString(text, -1) {
+		if !seen[id] {
+			seen[id] = true
+			refs = append(refs, BeaconRef{ID: id, Location: location})
+		}
+	}
+	return refs
+}
+
+// parentTagID returns the newest beacon already in the file at path, which
+// is the tag a re-tagged or derived document descends from. Beacons are
+// appended, so that is the last signed one found, failing that the last.
+func parentTagID(path string) string {
+	refs, err := ExtractBeacons(path)
+	if err != nil {
+		return ""
+	}
+	parent, signed := "", false
+	for _, b := range refs {
+		if b.URL == "" {
+			continue
+		}
+		if beaconToken(b.URL) != "" {
+			parent, signed = b.ID, true
+		} else if !signed {
+			parent = b.ID
+		}
+	}
+	return parent
+}
+
+// VerifyFile extracts the tags embedded in path and checks them against the
+// server.
+func (i *Instance) VerifyFile(ctx context.Context, path string) (Verification, error) {
+	v := Verification{Path: path}
+	hash, err := CalculateSHA256(path)
+	if err != nil {
+		return v, err
+	}
+	v.Hash = hash
+	v.Beacons, err = ExtractBeacons(path)
+	if err != nil {
+		return v, err
+	}
+
+	ids := make(map[string]bool)
+	inURL := make(map[string]bool)
+	for _, b := range v.Beacons {
+		if b.URL != "" {
+			inURL[b.ID] = true
+		}
+		if ids[b.ID] {
+			continue
+		}
+		ids[b.ID] = true
+		v.Tags = append(v.Tags, i.checkTag(ctx, b.ID, hash))
+	}
+	for k := range v.Tags {
+		i.checkSignatures(&v, &v.Tags[k])
+		if !v.Tags[k].Registered {
+			// still say who signed it when the server can't
+			i.checkBeaconsOffline(&v, &v.Tags[k])
+		}
+	}
+	registered := 0
+	for _, t := range v.Tags {
+		switch {
+		case t.Registered:
+			registered++
+			i.checkBeaconURLs(&v, t.ID)
+		case t.Error == "" && inURL[t.ID]:
+			// a bare unknown UUID may be anything; one in a URL is a beacon
+			v.Tampered = true
+			v.problem("beacon %s is not registered with the server", t.ID)
+		}
+	}
+	if roots := v.chainRoots(); roots > 1 {
+		v.problem("%d unrelated registered tags found", roots)
+	}
+	if registered == 0 {
+		i.checkStripped(ctx, &v)
+	}
+	return v, nil
+}
+
+// VerifyFileOffline checks the signatures the beacons in path carry without
+// contacting the server. It can tell which client signed each beacon, and
+// whether that client's key is trusted here, but not whether the tag was
+// registered or the file changed since.
+func (i *Instance) VerifyFileOffline(path string) (Verification, error) {
+	v := Verification{Path: path, Offline: true}
+	hash, err := CalculateSHA256(path)
+	if err != nil {
+		return v, err
+	}
+	v.Hash = hash
+	v.Beacons, err = ExtractBeacons(path)
+	if err != nil {
+		return v, err
+	}
+	ids := make(map[string]bool)
+	for _, b := range v.Beacons {
+		if b.URL == "" || ids[b.ID] {
+			continue
+		}
+		ids[b.ID] = true
+		c := TagCheck{ID: b.ID}
+		i.checkBeaconsOffline(&v, &c)
+		if c.BeaconClient == "" && !v.Tampered {
+			v.problem("beacon %s is unsigned, so it can't be checked offline", b.ID)
+		}
+		v.Tags = append(v.Tags, c)
+	}
+	return v, nil
+}
+
+// checkBeaconsOffline checks the signature each beacon of c's tag carries
+// against the client ID and key carried with it. Beacons made before they
+// carried those are skipped.
+func (i *Instance) checkBeaconsOffline(v *Verification, c *TagCheck) {
+	for _, b := range v.Beacons {
+		if b.ID != c.ID || b.URL == "" {
+			continue
+		}
+		token, client, key := beaconClaims(b.URL)
+		if token == "" || client == "" || key == "" {
+			continue
+		}
+		if !VerifyBeacon(c.ID, client, token, key) {
+			v.Tampered = true
+			v.problem("beacon %s in %s carries a signature that doesn't match its client and key", b.ID, b.Location)
+			continue
+		}
+		if c.BeaconClient != "" && (c.BeaconClient != client || c.BeaconKey != KeyFingerprint(key)) {
+			v.Tampered = true
+			v.problem("beacons of %s are signed by different clients", b.ID)
+			continue
+		}
+		c.BeaconClient, c.BeaconKey = client, KeyFingerprint(key)
+		c.KeyTrusted = i.trustedKey(client, key)
+	}
+}
+
+func (i *Instance) checkTag(ctx context.Context, id, hash string) TagCheck {
+	c := TagCheck{ID: id}
+	t, err := i.Client.GetTag(ctx, id)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return c
+	case err != nil:
+		c.Error = err.Error()
+		return c
+	}
+	c.Registered = true
+	c.Tag = t
+	c.HashMatch = t.TaggedHash != "" && t.TaggedHash == hash
+	return c
+}
+
+// checkBeaconURLs flags beacons for a registered tag that point somewhere
+// other than our server, which is what rerouting the beacon leaves behind.
+func (i *Instance) checkBeaconURLs(v *Verification, id string) {
+	ours, err := url.Parse(i.API.URL)
+	if err != nil {
+		return
+	}
+	for _, b := range v.Beacons {
+		if b.ID != id || b.URL == "" {
+			continue
+		}
+		u, err := url.Parse(b.URL)
+		if err != nil || !strings.EqualFold(u.Host, ours.Host) {
+			v.Tampered = true
+			v.problem("beacon %s in %s points at %s instead of %s", b.ID, b.Location, b.URL, ours.Host)
+		}
+	}
+}
+
+// checkSignatures verifies a registered tag's signature and the signature
+// carried by each of its beacons, both against the key it was registered
+// with. An unregistered beacon's signature can't be checked: it names no
+// key.
+func (i *Instance) checkSignatures(v *Verification, c *TagCheck) {
+	if !c.Registered || c.Tag.Signature == "" {
+		return
+	}
+	if err := VerifyTag(c.Tag); err != nil {
+		v.Tampered = true
+		v.problem("registration of tag %s has an invalid signature", c.ID)
+		return
+	}
+	c.Signer = c.Tag.ClientID
+	for _, b := range v.Beacons {
+		if b.ID != c.ID || b.URL == "" {
+			continue
+		}
+		switch token := beaconToken(b.URL); {
+		case token == "":
+			// stripping the signature is how a forged beacon would
+			// dodge this check
+			v.Tampered = true
+			v.problem("beacon %s in %s has no signature but its tag was signed", b.ID, b.Location)
+		case !VerifyBeacon(c.ID, c.Tag.ClientID, token, c.Tag.PublicKey):
+			v.Tampered = true
+			v.problem("beacon %s in %s carries a forged signature", b.ID, b.Location)
+		}
+	}
+}
+
+// beaconToken returns the signature in a beacon URL, if any.
+func beaconToken(beacon string) string {
+	token, _, _ := beaconClaims(beacon)
+	return token
+}
+
+// beaconClaims returns the signature in a beacon URL with the client ID and
+// key it names, see beaconParams.
+func beaconClaims(beacon string) (token, clientID, key string) {
+	u, err := url.Parse(beacon)
+	if err != nil {
+		return "", "", ""
+	}
+	q := u.Query()
+	return q.Get("t"), q.Get("c"), q.Get("k")
+}
+
+// chainRoots counts the registered tags found whose parent isn't among
+// them. Re-tagging leaves a chain of beacons with one root; more than one
+// root means unrelated tags were merged into one file.
+func (v Verification) chainRoots() int {
+	found := make(map[string]bool)
+	for _, t := range v.Tags {
+		if t.Registered {
+			found[t.ID] = true
+		}
+	}
+	roots := 0
+	for _, t := range v.Tags {
+		if t.Registered && !found[t.Tag.ParentID] {
+			roots++
+		}
+	}
+	return roots
+}
+
+// checkStripped looks for a registered tag with this file's hash. Finding
+// one means the file was tagged and the beacon has since been removed.
+func (i *Instance) checkStripped(ctx context.Context, v *Verification) {
+	tags, err := i.Client.ListTags(ctx, "")
+	if err != nil {
+		v.problem("could not search registered tags: %v", err)
+		return
+	}
+	for _, t := range tags {
+		switch v.Hash {
+		case t.TaggedHash:
+			v.problem("file matches the tagged copy of %s registered by %s but its beacon is missing", t.ID, t.Username)
+		case t.OriginalHash:
+			v.problem("file is the untagged original of %s registered by %s", t.ID, t.Username)
+		default:
+			continue
+		}
+		v.Stripped = true
+		v.Tags = append(v.Tags, TagCheck{ID: t.ID, Registered: true, Tag: t, HashMatch: v.Hash == t.TaggedHash})
+	}
+}
+
+// strategies lists the Word beacon strategies found for the tag id.
+func (v Verification) strategies(id string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, b := range v.Beacons {
+		if b.ID == id && b.Strategy != "" && !seen[b.Strategy] {
+			seen[b.Strategy] = true
+			out = append(out, b.Strategy)
+		}
+	}
+	return out
+}
+
+// String renders the verification for dialogs and the CLI.
+func (v Verification) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "File: %s\nSHA-256: %s\n", v.Path, v.Hash)
+	switch {
+	case v.Stripped:
+		b.WriteString("Status: beacon stripped\n")
+	case v.Tampered:
+		b.WriteString("Status: tampered\n")
+	case v.Tagged():
+		b.WriteString("Status: tagged\n")
+	default:
+		b.WriteString("Status: not tagged\n")
+	}
+	for _, t := range v.Tags {
+		if !t.Registered {
+			if t.BeaconClient != "" {
+				fmt.Fprintf(&b, "Tag %s signed by %s, key %s", t.ID, t.BeaconClient, t.BeaconKey)
+				if t.KeyTrusted {
+					b.WriteString(" (trusted)")
+				} else {
+					b.WriteString(" (not known here, so the client ID is only a claim)")
+				}
+				if v.Offline {
+					b.WriteString(", checked offline")
+				}
+				b.WriteString("\n")
+			}
+			continue
+		}
+		fmt.Fprintf(&b, "Tag %s by %s (%s)", t.ID, t.Tag.Username, t.Tag.FilePath)
+		if t.Signer != "" {
+			fmt.Fprintf(&b, ", signed by %s", t.Signer)
+		} else {
+			fmt.Fprintf(&b, ", claimed by %s (unverified)", t.Tag.ClientID)
+		}
+		if s := v.strategies(t.ID); len(s) > 0 {
+			fmt.Fprintf(&b, ", beacons: %s", strings.Join(s, ", "))
+		}
+		if t.Tag.Label != "" {
+			fmt.Fprintf(&b, ", labelled %s", t.Tag.Label)
+		}
+		if t.Tag.Recipient != "" {
+			fmt.Fprintf(&b, ", copy sent to %s", t.Tag.Recipient)
+		}
+		if t.Tag.ParentID != "" {
+			fmt.Fprintf(&b, ", derived from %s", t.Tag.ParentID)
+		}
+		if t.HashMatch {
+			b.WriteString(", hash matches")
+		} else {
+			b.WriteString(", hash differs from registration")
+		}
+		b.WriteString("\n")
+	}
+	for _, p := range v.Problems {
+		fmt.Fprintf(&b, "! %s\n", p)
+	}
+	return b.String()
+}
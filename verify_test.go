@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyFileOffline(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, colleague, _ := ed25519.GenerateKey(rand.Reader)
+	me, err := GetClientID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &Instance{API: API{URL: "http://tracker.example"}, Logger: log.New(io.Discard, "", 0), DeviceKey: key}
+	beacon := func(clientID string, key ed25519.PrivateKey) string {
+		other := &Instance{API: i.API, DeviceKey: key}
+		tag := Tag{ID: "9b2f6c1e-5d4a-4f3b-8c2d-1e0f9a8b7c6d", ClientID: clientID}
+		other.signBeacon(&tag)
+		return other.beaconURL(tag)
+	}
+	verify := func(t *testing.T, content string) Verification {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "doc.txt")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		v, err := i.VerifyFileOffline(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	t.Run("own key", func(t *testing.T) {
+		v := verify(t, beacon(me, key))
+		if !v.OK() || v.Tags[0].BeaconClient != me || !v.Tags[0].KeyTrusted {
+			t.Errorf("got %+v, want a trusted signature by %s", v, me)
+		}
+	})
+	t.Run("unknown key", func(t *testing.T) {
+		v := verify(t, beacon("alice@desk", colleague))
+		if v.OK() || v.Tampered || v.Tags[0].BeaconClient != "alice@desk" || v.Tags[0].KeyTrusted {
+			t.Errorf("got %+v, want a valid but untrusted signature", v)
+		}
+	})
+	t.Run("trusted devices", func(t *testing.T) {
+		path, err := DefaultTrustedDevicesPath()
+		if err != nil {
+			t.Fatal(err)
+		}
+		devices := map[string]map[string]string{
+			"alice@desk": {"account": "admin", "key": PublicKeyString(colleague.Public().(ed25519.PublicKey))},
+		}
+		data, _ := json.Marshal(devices)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path)
+		if v := verify(t, beacon("alice@desk", colleague)); !v.OK() {
+			t.Errorf("got %+v, want alice's key trusted", v)
+		}
+		// the key is alice's, not whoever claims it
+		if v := verify(t, beacon("mallory@desk", colleague)); v.OK() {
+			t.Errorf("got %+v, want mallory's claim untrusted", v)
+		}
+	})
+	t.Run("client swapped", func(t *testing.T) {
+		u := strings.Replace(beacon(me, key), "c="+strings.ReplaceAll(me, "@", "%40"), "c=alice%40desk", 1)
+		if v := verify(t, u); !v.Tampered || v.OK() {
+			t.Errorf("got %+v from %s, want tampered", v, u)
+		}
+	})
+}
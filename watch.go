@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchConfig lists the folders whose documents are tagged as soon as they
+// are created or changed.
+type WatchConfig struct {
+	Folders []WatchedFolder `json:"folders"`
+	// Ignore holds globs matched against file names and paths within a
+	// folder. The defaults skip hidden, temporary and backup files.
+	Ignore []string `json:"ignore"`
+	// Debounce is how long a file must stay unchanged before it's tagged,
+	// e.g. "2s".
+	Debounce string `json:"debounce"`
+	// Output is where tagged copies go. There is nobody to answer a save
+	// dialog, so the dialog mode writes copies next to the originals.
+	Output OutputConfig `json:"output"`
+}
+
+// WatchedFolder is one folder to tag documents in.
+type WatchedFolder struct {
+	Path      string   `json:"path"`
+	Recursive bool     `json:"recursive,omitempty"`
+	Ignore    []string `json:"ignore,omitempty"` // on top of WatchConfig.Ignore
+}
+
+// watchRetry is how often a folder that couldn't be watched is tried again.
+const watchRetry = 30 * time.Second
+
+func DefaultWatch() WatchConfig {
+	return WatchConfig{
+		Ignore:   []string{".*", "~$*", "*.tmp", "*.bak", "*.part", "*.crdownload"},
+		Debounce: "2s",
+		Output:   OutputConfig{Mode: OutputCopy, Suffix: DefaultOutput().Suffix},
+	}
+}
+
+func (c WatchConfig) debounce() time.Duration {
+	d, err := time.ParseDuration(c.Debounce)
+	if err != nil || d <= 0 {
+		return 2 * time.Second
+	}
+	return d
+}
+
+func (c WatchConfig) output() OutputConfig {
+	if c.Output.Mode == OutputDialog || c.Output.Mode == "" {
+		out := c.Output
+		out.Mode = OutputCopy
+		return out
+	}
+	return c.Output
+}
+
+// Watcher tags the supported documents that appear or change in the
+// watched folders. Changes are debounced, so a file is tagged once its
+// writer is done with it, and files whose hash is that of a tagged copy
+// made here are skipped, so outputs saved into a watched folder don't
+// trigger again.
+type Watcher struct {
+	instance *Instance
+	jobs     *JobQueue
+	fs       *fsnotify.Watcher
+	changed  chan struct{}
+	mu       sync.Mutex
+	cfg      WatchConfig
+	dirs     map[string]string // watched directory to the folder it's in
+	state    map[string]*FolderState
+	pending  map[string]*time.Timer
+	// OnChange is called when a folder's state changes.
+	OnChange func()
+	// OnConfigChange is called with the new configuration after folders
+	// are added or removed.
+	OnConfigChange func(WatchConfig)
+}
+
+// FolderState is what a watched folder has been up to.
+type FolderState struct {
+	Err    error     // why the folder isn't watched, if it isn't
+	Retry  time.Time // when watching it is tried again
+	Queued int       // files handed over for tagging
+	Last   string    // the last of them
+	When   time.Time // when it was queued
+}
+
+func NewWatcher(i *Instance, jobs *JobQueue, cfg WatchConfig) (*Watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		instance: i,
+		jobs:     jobs,
+		fs:       fw,
+		changed:  make(chan struct{}, 1),
+		dirs:     make(map[string]string),
+		state:    make(map[string]*FolderState),
+		pending:  make(map[string]*time.Timer),
+	}
+	w.cfg = cfg
+	folders := cfg.Folders
+	w.cfg.Folders = nil
+	for _, f := range folders {
+		w.watch(f)
+	}
+	return w, nil
+}
+
+// Add starts watching f and saves it in the configuration.
+func (w *Watcher) Add(f WatchedFolder) error {
+	path, err := filepath.Abs(f.Path)
+	if err != nil {
+		return err
+	}
+	f.Path = path
+	w.mu.Lock()
+	for _, g := range w.cfg.Folders {
+		if g.Path == f.Path {
+			w.mu.Unlock()
+			return fmt.Errorf("%s is already watched", f.Path)
+		}
+	}
+	w.mu.Unlock()
+	err = w.watch(f)
+	w.configChanged()
+	return err
+}
+
+// Remove stops watching the folder at path.
+func (w *Watcher) Remove(path string) {
+	w.mu.Lock()
+	for k, f := range w.cfg.Folders {
+		if f.Path == path {
+			w.cfg.Folders = append(w.cfg.Folders[:k:k], w.cfg.Folders[k+1:]...)
+			break
+		}
+	}
+	for dir, root := range w.dirs {
+		if root == path {
+			w.fs.Remove(dir)
+			delete(w.dirs, dir)
+		}
+	}
+	delete(w.state, path)
+	w.mu.Unlock()
+	w.configChanged()
+}
+
+// Folders returns the watched folders with their state.
+func (w *Watcher) Folders() ([]WatchedFolder, []FolderState) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	folders := append([]WatchedFolder(nil), w.cfg.Folders...)
+	states := make([]FolderState, len(folders))
+	for k, f := range folders {
+		if s := w.state[f.Path]; s != nil {
+			states[k] = *s
+		}
+	}
+	return folders, states
+}
+
+// watch adds f and, for a recursive folder, the directories below it. A
+// folder that can't be watched yet, e.g. an unmounted share, is kept with
+// its error and tried again every watchRetry.
+func (w *Watcher) watch(f WatchedFolder) error {
+	w.mu.Lock()
+	w.cfg.Folders = append(w.cfg.Folders, f)
+	st := &FolderState{}
+	w.state[f.Path] = st
+	w.mu.Unlock()
+	return w.tryWatch(f, st)
+}
+
+func (w *Watcher) tryWatch(f WatchedFolder, st *FolderState) error {
+	err := w.addDirs(f.Path, f)
+	w.mu.Lock()
+	if w.state[f.Path] != st {
+		// removed while we were at it
+		w.mu.Unlock()
+		return err
+	}
+	st.Err, st.Retry = err, time.Time{}
+	if err != nil {
+		w.instance.Logger.Printf("Error watching %s: %v", f.Path, err)
+		st.Retry = time.Now().Add(watchRetry)
+		time.AfterFunc(watchRetry, func() { w.tryWatch(f, st) })
+	}
+	w.mu.Unlock()
+	w.notify()
+	return err
+}
+
+func (w *Watcher) addDirs(dir string, f WatchedFolder) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != dir && (!f.Recursive || w.ignored(f, path)) {
+			return filepath.SkipDir
+		}
+		if err := w.fs.Add(path); err != nil {
+			return err
+		}
+		w.mu.Lock()
+		w.dirs[path] = f.Path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// Run handles file system events until ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context) {
+	defer w.fs.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-w.fs.Events:
+			if !ok {
+				return
+			}
+			w.handle(ev)
+		case err, ok := <-w.fs.Errors:
+			if !ok {
+				return
+			}
+			w.instance.Logger.Println("Error watching folders:", err)
+		case <-w.changed:
+			if w.OnChange != nil {
+				w.OnChange()
+			}
+		}
+	}
+}
+
+func (w *Watcher) handle(ev fsnotify.Event) {
+	w.mu.Lock()
+	root, ok := w.dirs[filepath.Dir(ev.Name)]
+	var f WatchedFolder
+	for _, g := range w.cfg.Folders {
+		if g.Path == root {
+			f = g
+		}
+	}
+	w.mu.Unlock()
+	if !ok || w.ignored(f, ev.Name) {
+		return
+	}
+	if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+		w.mu.Lock()
+		if t := w.pending[ev.Name]; t != nil {
+			t.Stop()
+			delete(w.pending, ev.Name)
+		}
+		w.mu.Unlock()
+		return
+	}
+	if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+		return
+	}
+	info, err := os.Stat(ev.Name)
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		if f.Recursive && ev.Has(fsnotify.Create) {
+			if err := w.addDirs(ev.Name, f); err != nil {
+				w.instance.Logger.Printf("Error watching %s: %v", ev.Name, err)
+			}
+		}
+		return
+	}
+	if !isTaggable(ev.Name) {
+		return
+	}
+	// restart the quiet period on every write
+	w.mu.Lock()
+	if t := w.pending[ev.Name]; t != nil {
+		t.Stop()
+	}
+	path := ev.Name
+	w.pending[path] = time.AfterFunc(w.cfg.debounce(), func() { w.settled(f, path) })
+	w.mu.Unlock()
+}
+
+// settled queues path for tagging once it has stopped changing.
+func (w *Watcher) settled(f WatchedFolder, path string) {
+	w.mu.Lock()
+	delete(w.pending, path)
+	out := w.cfg.output()
+	_, watched := w.state[f.Path]
+	w.mu.Unlock()
+	if !watched {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	hash, err := CalculateSHA256(path)
+	if err != nil {
+		w.instance.Logger.Printf("Error reading %s: %v", path, err)
+		return
+	}
+	if w.instance.IsTaggedCopy(hash) {
+		return
+	}
+	w.instance.Logger.Println("Tagging watched file", path)
+	w.jobs.AddAs(path, out)
+	w.mu.Lock()
+	if st := w.state[f.Path]; st != nil {
+		st.Queued++
+		st.Last, st.When = path, time.Now()
+	}
+	w.mu.Unlock()
+	w.notify()
+}
+
+// ignored matches path against the ignore globs by name and by its path
+// within f.
+func (w *Watcher) ignored(f WatchedFolder, path string) bool {
+	w.mu.Lock()
+	globs := append(append([]string(nil), w.cfg.Ignore...), f.Ignore...)
+	w.mu.Unlock()
+	name := filepath.Base(path)
+	rel, err := filepath.Rel(f.Path, path)
+	if err != nil {
+		rel = name
+	}
+	rel = filepath.ToSlash(rel)
+	for _, g := range globs {
+		if ok, _ := filepath.Match(g, name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(g, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Watcher) configChanged() {
+	w.mu.Lock()
+	cfg := w.cfg
+	cfg.Folders = append([]WatchedFolder(nil), w.cfg.Folders...)
+	w.mu.Unlock()
+	if w.OnConfigChange != nil {
+		w.OnConfigChange(cfg)
+	}
+	w.notify()
+}
+
+// notify has Run call OnChange, so it is only ever called from one
+// goroutine.
+func (w *Watcher) notify() {
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+// isTaggable reports whether TagFile handles files like path.
+func isTaggable(path string) bool {
+	switch documentKind(path) {
+	case "PDF", "Word Document", "OpenDocument":
+		return true
+	}
+	return false
+}
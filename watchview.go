@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// WatchView lists the watched folders and what each has been doing, and
+// lets the user add and remove folders.
+type WatchView struct {
+	watcher   *Watcher
+	window    fyne.Window
+	list      *widget.List
+	recursive *widget.Check
+	mu        sync.Mutex
+	folders   []WatchedFolder
+	states    []FolderState
+}
+
+func NewWatchView(w *Watcher, window fyne.Window) *WatchView {
+	v := &WatchView{watcher: w, window: window}
+	v.recursive = widget.NewCheck("Include subfolders", nil)
+	v.list = widget.NewList(
+		func() int {
+			v.mu.Lock()
+			defer v.mu.Unlock()
+			return len(v.folders)
+		},
+		func() fyne.CanvasObject {
+			remove := widget.NewButtonWithIcon("", theme.DeleteIcon(), nil)
+			return container.NewBorder(nil, nil, nil, remove,
+				container.NewVBox(widget.NewLabel(""), widget.NewLabel("")))
+		},
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			v.mu.Lock()
+			if id >= len(v.folders) {
+				v.mu.Unlock()
+				return
+			}
+			f, st := v.folders[id], v.states[id]
+			v.mu.Unlock()
+			row := o.(*fyne.Container).Objects
+			lines := row[0].(*fyne.Container).Objects
+			title := lines[0].(*widget.Label)
+			title.SetText(f.Path)
+			title.TextStyle = fyne.TextStyle{Bold: true}
+			title.Refresh()
+			lines[1].(*widget.Label).SetText(folderStatus(f, st))
+			row[1].(*widget.Button).OnTapped = func() { v.watcher.Remove(f.Path) }
+		},
+	)
+	w.OnChange = v.Refresh
+	v.Refresh()
+	return v
+}
+
+// Widget returns the panel for embedding in the main window.
+func (v *WatchView) Widget() fyne.CanvasObject {
+	add := widget.NewButtonWithIcon("Watch folder…", theme.FolderOpenIcon(), v.add)
+	top := container.NewHBox(add, v.recursive)
+	return container.NewBorder(top, nil, nil, nil, v.list)
+}
+
+// Refresh reloads the folders from the watcher.
+func (v *WatchView) Refresh() {
+	folders, states := v.watcher.Folders()
+	v.mu.Lock()
+	v.folders, v.states = folders, states
+	v.mu.Unlock()
+	v.list.Refresh()
+}
+
+func (v *WatchView) add() {
+	dialog.ShowFolderOpen(func(dir fyne.ListableURI, err error) {
+		if err != nil || dir == nil {
+			return
+		}
+		f := WatchedFolder{Path: dir.Path(), Recursive: v.recursive.Checked}
+		if err := v.watcher.Add(f); err != nil {
+			dialog.ShowError(err, v.window)
+		}
+	}, v.window)
+}
+
+func folderStatus(f WatchedFolder, st FolderState) string {
+	if st.Err != nil {
+		if !st.Retry.IsZero() {
+			return fmt.Sprintf("Not watched, retrying at %s: %v", st.Retry.Format("15:04:05"), st.Err)
+		}
+		return "Not watched: " + st.Err.Error()
+	}
+	s := "Watching"
+	if f.Recursive {
+		s += " with subfolders"
+	}
+	switch st.Queued {
+	case 0:
+		return s + ", nothing to tag yet"
+	case 1:
+		s += ", 1 file queued"
+	default:
+		s += fmt.Sprintf(", %d files queued", st.Queued)
+	}
+	return fmt.Sprintf("%s, last %s at %s", s, filepath.Base(st.Last), st.When.Format("15:04:05"))
+}
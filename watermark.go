@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// WatermarkConfig is the visible watermark in config.json.
+type WatermarkConfig struct {
+	// Template renders the watermark text from the Tag, e.g.
+	// {{.Username}}, {{.Recipient}}, {{.Label}} or {{date .Created}}.
+	Template string `json:"template"`
+	// Color is the Word watermark fill; PDFs are always grey.
+	Color string `json:"color"`
+}
+
+func DefaultWatermark() WatermarkConfig {
+	return WatermarkConfig{
+		Template: `CONFIDENTIAL – {{or .Recipient .Username}} – {{date .Created}}`,
+		Color:    "silver",
+	}
+}
+
+var watermarkFuncs = template.FuncMap{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"date": func(unix int) string {
+		return time.Unix(int64(unix), 0).Format("2006-01-02")
+	},
+	"short": func(id string) string {
+		if len(id) > 8 {
+			return id[:8]
+		}
+		return id
+	},
+}
+
+// Render fills the template in from t.
+func (c WatermarkConfig) Render(t Tag) (string, error) {
+	text := c.Template
+	if text == "" {
+		text = DefaultWatermark().Template
+	}
+	tmpl, err := template.New("watermark").Funcs(watermarkFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, t); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// applyWatermark records the watermark text on t when watermarking is on.
+func (i *Instance) applyWatermark(t *Tag) {
+	if !i.Watermark {
+		return
+	}
+	text, err := i.Config.Watermark.Render(*t)
+	if err != nil {
+		i.Logger.Println("Error rendering watermark:", err)
+		return
+	}
+	t.Watermark = text
+}
+
+const (
+	nsVML       = "urn:schemas-microsoft-com:vml"
+	nsVMLOffice = "urn:schemas-microsoft-com:office:office"
+)
+
+// watermarkDocx puts t's watermark diagonally behind the text of every
+// page, the way Word's own watermarks are drawn: a VML text path anchored
+// in the header.
+func watermarkDocx(data []byte, cfg WatermarkConfig, t Tag) ([]byte, error) {
+	pkg, err := OpenPackage(data)
+	if err != nil {
+		return nil, err
+	}
+	color := cfg.Color
+	if color == "" {
+		color = DefaultWatermark().Color
+	}
+	err = addToWordHeaders(pkg, "header", true, func(_ string, root *etree.Element, n int) error {
+		if root.SelectAttr("xmlns:v") == nil {
+			root.CreateAttr("xmlns:v", nsVML)
+		}
+		if root.SelectAttr("xmlns:o") == nil {
+			root.CreateAttr("xmlns:o", nsVMLOffice)
+		}
+		root.AddChild(watermarkParagraph(t.Watermark, color, n))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("watermark: %w", err)
+	}
+	return pkg.Bytes()
+}
+
+// watermarkParagraph is a paragraph holding the watermark shape; n keeps
+// shape IDs unique across headers.
+func watermarkParagraph(text, color string, n int) *etree.Element {
+	p := etree.NewElement("w:p")
+	r := p.CreateElement("w:r")
+	r.CreateElement("w:rPr").CreateElement("w:noProof")
+	pict := r.CreateElement("w:pict")
+	pict.AddChild(textPathShapeType())
+
+	// a rough fit: Word stretches the text path to the shape's box
+	width := 6.5 * 72
+	height := width / float64(len([]rune(text))) * 1.6
+	if height > 150 {
+		height = 150
+	}
+	shape := pict.CreateElement("v:shape")
+	shape.CreateAttr("id", fmt.Sprintf("DlpWatermark%d", n+1))
+	shape.CreateAttr("o:spid", fmt.Sprintf("_x0000_s%d", 4097+n))
+	shape.CreateAttr("type", "#_x0000_t136")
+	shape.CreateAttr("style", fmt.Sprintf("position:absolute;margin-left:0;margin-top:0;width:%.1fpt;height:%.1fpt;"+
+		"rotation:315;z-index:-251654144;mso-position-horizontal:center;mso-position-horizontal-relative:margin;"+
+		"mso-position-vertical:center;mso-position-vertical-relative:margin", width, height))
+	shape.CreateAttr("o:allowincell", "f")
+	shape.CreateAttr("fillcolor", color)
+	shape.CreateAttr("stroked", "f")
+	shape.CreateElement("v:fill").CreateAttr("opacity", ".5")
+	tp := shape.CreateElement("v:textpath")
+	tp.CreateAttr("style", `font-family:"Calibri";font-size:1pt`)
+	tp.CreateAttr("string", text)
+	return p
+}
+
+// textPathShapeType is VML's predefined WordArt "plain text" shape, which
+// every watermark shape refers to.
+func textPathShapeType() *etree.Element {
+	st := etree.NewElement("v:shapetype")
+	st.CreateAttr("id", "_x0000_t136")
+	st.CreateAttr("coordsize", "21600,21600")
+	st.CreateAttr("o:spt", "136")
+	st.CreateAttr("adj", "10800")
+	st.CreateAttr("path", "m@7,l@8,m@5,21600l@6,21600e")
+	formulas := st.CreateElement("v:formulas")
+	for _, eqn := range []string{
+		"sum #0 0 10800", "prod #0 2 1", "sum 21600 0 @1", "sum 0 0 @2", "sum 21600 0 @3",
+		"if @0 @3 0", "if @0 21600 @1", "if @0 0 @2", "if @0 @4 21600", "mid @5 @6",
+		"mid @8 @5", "mid @7 @8", "mid @6 @7", "sum @6 0 @5",
+	} {
+		formulas.CreateElement("v:f").CreateAttr("eqn", eqn)
+	}
+	path := st.CreateElement("v:path")
+	path.CreateAttr("textpathok", "t")
+	path.CreateAttr("o:connecttype", "custom")
+	path.CreateAttr("o:connectlocs", "@9,0;@10,10800;@11,21600;@12,10800")
+	path.CreateAttr("o:connectangles", "270,180,90,0")
+	tp := st.CreateElement("v:textpath")
+	tp.CreateAttr("on", "t")
+	tp.CreateAttr("fitshape", "t")
+	h := st.CreateElement("v:handles").CreateElement("v:h")
+	h.CreateAttr("position", "#0,bottomRight")
+	h.CreateAttr("xrange", "6629,14971")
+	lock := st.CreateElement("o:lock")
+	lock.CreateAttr("v:ext", "edit")
+	lock.CreateAttr("text", "t")
+	lock.CreateAttr("shapetype", "t")
+	return st
+}